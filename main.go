@@ -1,21 +1,168 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/teshomenbret/torrent/leecher"
 )
 
 func main() {
-	inPath := os.Args[1]
-	torrentFile, err := leecher.OpenTorrentFile(inPath)
+	if len(os.Args) < 2 {
+		log.Fatal("usage: main <file.torrent|magnet URI>... | main scrape <file.torrent>... | main seed [-ratio r] [-time d] <file.torrent>")
+	}
+	switch os.Args[1] {
+	case "scrape":
+		scrape(os.Args[2:])
+		return
+	case "seed":
+		seed(os.Args[2:])
+		return
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if len(os.Args) > 2 {
+		downloadAll(ctx, os.Args[1:])
+		return
+	}
+	torrentFile, err := openTorrent(os.Args[1])
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = torrentFile.DownloadTorrentFile()
+	err = torrentFile.DownloadTorrentFile(ctx)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+
+}
+
+// openTorrent reads a torrent file or fetches the metadata of a magnet link
+func openTorrent(inPath string) (leecher.TorrentFile, error) {
+	if strings.HasPrefix(inPath, "magnet:") {
+		return leecher.OpenMagnet(inPath)
+	}
+	return leecher.OpenTorrentFile(inPath)
+}
+
+// downloadAll downloads and seeds several torrents in one session until
+// all of them are done or ctx is cancelled
+func downloadAll(ctx context.Context, paths []string) {
+	session, err := leecher.NewSession(leecher.SessionConfig{SeedLimits: leecher.DefaultSeedLimits})
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer session.Close()
+	for _, path := range paths {
+		torrentFile, err := openTorrent(path)
+		if err == nil {
+			err = session.Add(torrentFile)
+		}
+		if err != nil {
+			log.Printf("%s: %v\n", path, err)
+		}
+	}
 
+	states := make(map[[20]byte]leecher.TorrentState)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		running := 0
+		for _, status := range session.Torrents() {
+			if state, ok := states[status.InfoHash]; !ok || state != status.State {
+				log.Printf("%s is %s\n", status.Name, status.State)
+				states[status.InfoHash] = status.State
+			}
+			if status.State != leecher.StatePaused && status.State != leecher.StateError {
+				running++
+			}
+		}
+		if running == 0 {
+			return
+		}
+	}
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM,
+// so the torrent can say goodbye to its trackers and flush its data. A
+// second signal kills the process.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			log.Println("Shutting down, interrupt again to quit immediately")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
+// scrape prints the swarm statistics of every torrent file
+func scrape(paths []string) {
+	if len(paths) == 0 {
+		log.Fatal("usage: main scrape <file.torrent>...")
+	}
+	failed := false
+	for _, path := range paths {
+		torrentFile, err := leecher.OpenTorrentFile(path)
+		if err != nil {
+			log.Printf("%s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		res, err := torrentFile.Scrape()
+		if err != nil {
+			log.Printf("%s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s\n  infohash:   %x\n  seeders:    %d\n  leechers:   %d\n  downloaded: %d\n",
+			torrentFile.Name, res.InfoHash, res.Complete, res.Incomplete, res.Downloaded)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// seed uploads a torrent whose data is already complete in the working
+// directory
+func seed(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	ratio := flags.Float64("ratio", 0, "stop after uploading this many times the torrent's size (0 for no limit)")
+	duration := flags.Duration("time", 0, "stop after seeding this long (0 for no limit)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("usage: main seed [-ratio r] [-time d] <file.torrent>")
+	}
+
+	torrentFile, err := leecher.OpenTorrentFile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	limits := leecher.SeedLimits{Ratio: *ratio, Time: *duration}
+	ctx, stop := signalContext()
+	defer stop()
+	err = torrentFile.Seed(ctx, leecher.FileStorage{Dir: "."}, limits)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,199 @@
+package leecher
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// defaultAnnounceInterval is used when a tracker does not send one
+	defaultAnnounceInterval = 30 * time.Minute
+	// announceRetryInterval is how long to wait after every tracker failed
+	announceRetryInterval = time.Minute
+	// stoppedTimeout bounds the stopped announce, which outlives the
+	// torrent's context
+	stoppedTimeout = 5 * time.Second
+)
+
+// announcer keeps the trackers of a torrent informed for as long as the
+// torrent is active and hands every peer they return to the download
+type announcer struct {
+	tf      *TorrentFile
+	torrent *Torrent
+	port    uint16
+	key     uint32
+	ipv6    net.IP
+	// tiers is our copy of the trackers, reordered as they answer
+	tiers [][]string
+	// trackerIDs holds the tracker id of every tracker that sent one
+	trackerIDs map[string]string
+	udpRetries int
+	events     chan uint32
+	done       chan struct{}
+	// earliest is when the trackers allow us to announce again
+	earliest time.Time
+	// startPending is set until an announce with the started event
+	// succeeded
+	startPending bool
+}
+
+func newAnnouncer(tf *TorrentFile, torrent *Torrent, port uint16, udpRetries int) (*announcer, error) {
+	key, err := randomUint32()
+	if err != nil {
+		return nil, err
+	}
+	return &announcer{
+		tf:         tf,
+		torrent:    torrent,
+		tiers:      tf.trackerTiers(),
+		port:       port,
+		key:        key,
+		ipv6:       localIPv6(),
+		trackerIDs: make(map[string]string),
+		udpRetries: udpRetries,
+		events:     make(chan uint32),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// start sends the started event and returns the first batch of peers. The
+// re-announce loop runs in the background afterwards, also when the first
+// announce failed, so stop must always be called. Cancelling ctx aborts a
+// running announce and ends the loop.
+func (a *announcer) start(ctx context.Context) ([]Peer, error) {
+	resp, err := a.announce(ctx, eventStarted)
+	if err != nil {
+		// The trackers haven't heard of us yet, the next announce
+		// sends started again
+		a.startPending = true
+		a.earliest = time.Now().Add(announceRetryInterval)
+		go a.run(ctx, announceRetryInterval)
+		return nil, err
+	}
+	a.earliest = time.Now().Add(a.minAnnounce(resp))
+	go a.run(ctx, a.nextAnnounce(resp))
+	return resp.peers, nil
+}
+
+// completed tells the trackers that the download has finished
+func (a *announcer) completed() {
+	select {
+	case a.events <- eventCompleted:
+	case <-a.done: // ctx was cancelled
+	}
+}
+
+// stop sends the stopped event and ends the re-announce loop
+func (a *announcer) stop() {
+	select {
+	case a.events <- eventStopped:
+	case <-a.done:
+	}
+	<-a.done
+}
+
+func (a *announcer) run(ctx context.Context, wait time.Duration) {
+	defer close(a.done)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		event := uint32(eventNone)
+		select {
+		case <-timer.C:
+		case event = <-a.events:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-ctx.Done():
+			event = eventStopped
+		case <-a.torrent.wantPeersSignal():
+			// The download runs out of peers. Announce early if the
+			// trackers allow it, the next regular announce is soon
+			// enough otherwise.
+			if time.Now().Before(a.earliest) {
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		if event == eventStopped {
+			a.sendStopped()
+			return
+		}
+		if event == eventNone && a.startPending {
+			event = eventStarted
+		}
+
+		resp, err := a.announce(ctx, event)
+		if ctx.Err() != nil {
+			a.sendStopped()
+			return
+		}
+		if err != nil {
+			log.Println("Announce failed:", err)
+			a.earliest = time.Now().Add(announceRetryInterval)
+			timer.Reset(announceRetryInterval)
+			continue
+		}
+		if event == eventStarted {
+			a.startPending = false
+		}
+		log.Printf("Tracker returned %d peers\n", len(resp.peers))
+		a.torrent.AddPeers(resp.peers)
+		a.earliest = time.Now().Add(a.minAnnounce(resp))
+		timer.Reset(a.nextAnnounce(resp))
+	}
+}
+
+// sendStopped tells the trackers that we leave. It does not depend on the
+// torrent's context, which is usually cancelled by now, but gives up after
+// stoppedTimeout so that stopping a torrent never hangs on a tracker.
+func (a *announcer) sendStopped() {
+	if a.startPending {
+		return // the trackers never saw started
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+	defer cancel()
+	a.announce(ctx, eventStopped)
+}
+
+func (a *announcer) announce(ctx context.Context, event uint32) (*trackerResponse, error) {
+	return a.tf.announce(ctx, a.tiers, announceParams{
+		peerID:     a.torrent.PeerID,
+		port:       a.port,
+		uploaded:   a.torrent.uploaded.Load(),
+		downloaded: a.torrent.downloaded.Load(),
+		left:       a.torrent.bytesLeft(),
+		event:      event,
+		key:        a.key,
+		ipv6:       a.ipv6,
+		trackerIDs: a.trackerIDs,
+		udpRetries: a.udpRetries,
+	})
+}
+
+// minAnnounce is how long the tracker wants us to wait at least before
+// announcing again
+func (a *announcer) minAnnounce(resp *trackerResponse) time.Duration {
+	if resp.minInterval > 0 {
+		return resp.minInterval
+	}
+	return announceRetryInterval
+}
+
+// nextAnnounce is the tracker's interval, but never less than its min
+// interval
+func (a *announcer) nextAnnounce(resp *trackerResponse) time.Duration {
+	wait := resp.interval
+	if wait <= 0 {
+		wait = defaultAnnounceInterval
+	}
+	if wait < resp.minInterval {
+		wait = resp.minInterval
+	}
+	return wait
+}
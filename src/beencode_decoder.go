@@ -209,10 +209,11 @@ func (b *structBuilder) Key(k string) builder {
 			break
 		}
 		key := reflect.ValueOf(k)
-		elem := v.MapIndex(key)
-		if !elem.IsValid() {
-			v.SetMapIndex(key, reflect.Zero(t.Elem()))
-			elem = v.MapIndex(key)
+		// Build the value in an addressable copy so that structs and maps
+		// can be filled in; Flush stores it in the map.
+		elem := reflect.New(t.Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			elem.Set(existing)
 		}
 		return &structBuilder{val: elem, map_: v, key: key}
 	}
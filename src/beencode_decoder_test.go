@@ -0,0 +1,46 @@
+package leecher
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalMapOfStructs(t *testing.T) {
+	type stats struct {
+		Complete   int `bencode:"complete"`
+		Downloaded int `bencode:"downloaded"`
+		Incomplete int `bencode:"incomplete"`
+	}
+	var resp struct {
+		Files map[string]stats `bencode:"files"`
+	}
+	data := "d5:filesd" +
+		"3:aaad8:completei5e10:downloadedi50e10:incompletei10ee" +
+		"3:bbbd8:completei1e10:downloadedi2e10:incompletei3ee" +
+		"ee"
+	if err := UnmarshalResponse(strings.NewReader(data), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]stats{
+		"aaa": {Complete: 5, Downloaded: 50, Incomplete: 10},
+		"bbb": {Complete: 1, Downloaded: 2, Incomplete: 3},
+	}
+	if !reflect.DeepEqual(resp.Files, want) {
+		t.Errorf("got %+v, want %+v", resp.Files, want)
+	}
+}
+
+func TestUnmarshalMapOfMaps(t *testing.T) {
+	var v map[string]map[string]int
+	if err := UnmarshalResponse(strings.NewReader("d1:ad1:xi1e1:yi2ee1:bd1:zi3eee"), &v); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]int{
+		"a": {"x": 1, "y": 2},
+		"b": {"z": 3},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %v, want %v", v, want)
+	}
+}
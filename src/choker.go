@@ -0,0 +1,185 @@
+package leecher
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultUploadSlots is how many peers are unchoked for their rate
+	DefaultUploadSlots = 4
+	// chokeInterval is how often the choker re-evaluates the peers
+	chokeInterval = 10 * time.Second
+	// optimisticRounds is how many choke rounds an optimistic unchoke
+	// lasts, 30 seconds with chokeInterval
+	optimisticRounds = 3
+)
+
+// choker decides which peers may download from us. Every round the
+// interested peers that gave us the most data, or took the most when we
+// seed, are unchoked. One more peer is unchoked at random so new peers get
+// a chance to prove themselves.
+type choker struct {
+	torrent    *Torrent
+	rnd        *rand.Rand
+	round      int
+	optimistic *Client
+	// last holds the byte counter of each peer at the previous round
+	last map[*Client]int64
+}
+
+func newChoker(t *Torrent) *choker {
+	return &choker{
+		torrent: t,
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		last:    make(map[*Client]int64),
+	}
+}
+
+// runChoker re-evaluates the peers every chokeInterval until stop is
+// closed
+func (t *Torrent) runChoker(stop <-chan struct{}) {
+	ch := newChoker(t)
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	ch.rechoke()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ch.rechoke()
+		case <-t.chokeSignal():
+			ch.fillSlots()
+		}
+	}
+}
+
+// chokeSignal is notified when a peer becomes interested
+func (t *Torrent) chokeSignal() chan struct{} {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	if t.chokeNotify == nil {
+		t.chokeNotify = make(chan struct{}, 1)
+	}
+	return t.chokeNotify
+}
+
+// uploadSlots is the number of regular unchoke slots
+func (t *Torrent) uploadSlots() int {
+	if t.UploadSlots > 0 {
+		return t.UploadSlots
+	}
+	return DefaultUploadSlots
+}
+
+// rechoke sends Choke and Unchoke messages so exactly the peers picked by
+// unchokeSet are unchoked
+func (ch *choker) rechoke() {
+	clients := ch.torrent.connectedClients()
+	unchoke := ch.unchokeSet(clients, ch.torrent.bytesLeft() == 0)
+	for _, c := range clients {
+		c.uploadMu.Lock()
+		unchoked := c.peerUnchoked
+		c.uploadMu.Unlock()
+		if unchoke[c] && !unchoked {
+			c.SendUnchoke()
+		} else if !unchoke[c] && unchoked {
+			c.SendChoke()
+		}
+	}
+}
+
+// fillSlots unchokes interested peers right away while there are free
+// slots, instead of making them wait for the next round
+func (ch *choker) fillSlots() {
+	clients := ch.torrent.connectedClients()
+	free := ch.torrent.uploadSlots() + 1 // the optimistic slot
+	var waiting []*Client
+	for _, c := range clients {
+		c.uploadMu.Lock()
+		unchoked, isInterested := c.peerUnchoked, c.peerInterested
+		c.uploadMu.Unlock()
+		if unchoked {
+			free--
+		} else if isInterested {
+			waiting = append(waiting, c)
+		}
+	}
+	for i := 0; i < free && i < len(waiting); i++ {
+		waiting[i].SendUnchoke()
+	}
+}
+
+// unchokeSet picks the peers to unchoke this round
+func (ch *choker) unchokeSet(clients []*Client, seeding bool) map[*Client]bool {
+	type candidate struct {
+		client *Client
+		rate   int64
+	}
+	var interested []candidate
+	connected := make(map[*Client]int64, len(clients))
+	for _, c := range clients {
+		count := c.downloadedBytes.Load()
+		if seeding {
+			count = c.uploadedBytes.Load()
+		}
+		connected[c] = count
+		c.uploadMu.Lock()
+		isInterested := c.peerInterested
+		c.uploadMu.Unlock()
+		if isInterested {
+			interested = append(interested, candidate{c, count - ch.last[c]})
+		}
+	}
+	ch.last = connected
+
+	sort.SliceStable(interested, func(i, j int) bool {
+		return interested[i].rate > interested[j].rate
+	})
+	unchoke := make(map[*Client]bool)
+	slots := ch.torrent.uploadSlots()
+	var rest []*Client
+	for i, cand := range interested {
+		if i < slots {
+			unchoke[cand.client] = true
+		} else {
+			rest = append(rest, cand.client)
+		}
+	}
+
+	// Keep the optimistic unchoke for optimisticRounds rounds unless it
+	// left, lost interest or earned a regular slot
+	if ch.round%optimisticRounds == 0 || !contains(rest, ch.optimistic) {
+		ch.optimistic = nil
+	}
+	if ch.optimistic == nil && len(rest) > 0 {
+		ch.optimistic = rest[ch.rnd.Intn(len(rest))]
+	}
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+	ch.round++
+	return unchoke
+}
+
+func contains(clients []*Client, c *Client) bool {
+	for _, other := range clients {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+// connectedClients returns a snapshot of the torrent's connections
+func (t *Torrent) connectedClients() []*Client {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	clients := make([]*Client, 0, len(t.connected))
+	for _, c := range t.connected {
+		clients = append(clients, c)
+	}
+	return clients
+}
@@ -1,8 +1,10 @@
 package leecher
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -30,53 +32,180 @@ func completeHandShake(conn net.Conn, infohash, peerID [20]byte) (*HandShake, er
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+// ProtocolError is returned when a peer sends something the wire protocol
+// does not allow
+type ProtocolError struct {
+	Peer   string
+	Reason string
+}
 
-	msg, err := messageReader(conn)
-	if err != nil {
-		return nil, err
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("peer %s broke the protocol: %s", e.Peer, e.Reason)
+}
+
+// recvBitfield waits for the peer to say which pieces it has. That is a
+// bitfield, or Have All or Have None if it speaks the fast extension. A
+// peer without pieces may skip the bitfield; its first message is then
+// handled as usual and the peer starts with an empty bitfield. Extended
+// messages sent before (usually the extended handshake) are handled on
+// the way.
+func (c *Client) recvBitfield() (Bitfield, error) {
+	c.Bitfield = make(Bitfield, (c.numPieces+7)/8)
+	deadline := time.Now().Add(5 * time.Second)
+	defer c.Conn.SetDeadline(time.Time{})
+
+	for {
+		ready, err := c.waitMessage(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		if !ready {
+			return c.Bitfield, nil // a peer without pieces may stay silent
+		}
+		c.Conn.SetDeadline(deadline)
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case msg == nil:
+			continue // keep-alive
+		case msg.ID == MsgExtended:
+			if err := c.handleExtended(msg); err != nil {
+				return nil, err
+			}
+			continue
+		case msg.ID == MsgBitfield:
+			if err := c.checkBitfield(msg.Payload); err != nil {
+				return nil, err
+			}
+			c.Bitfield = msg.Payload
+		case c.supportsFast && (msg.ID == MsgHaveAll || msg.ID == MsgHaveNone):
+			if len(msg.Payload) != 0 {
+				return nil, &ProtocolError{Peer: c.peer.String(), Reason: fmt.Sprintf("unexpected payload in %s", msg)}
+			}
+			if msg.ID == MsgHaveAll {
+				for index := 0; index < c.numPieces; index++ {
+					c.Bitfield.SetPiece(index)
+				}
+			}
+		default:
+			if err := c.handleMessage(msg, nil); err != nil {
+				return nil, err
+			}
+		}
+		return c.Bitfield, nil
 	}
-	if msg.ID != MsgBitfield {
-		err := fmt.Errorf("expected bitfield but got ID %d", msg.ID)
-		return nil, err
+}
+
+// checkBitfield verifies that a bitfield has one bit per piece and that
+// the spare bits at the end are cleared
+func (c *Client) checkBitfield(bf Bitfield) error {
+	if len(bf) != (c.numPieces+7)/8 {
+		return &ProtocolError{Peer: c.peer.String(), Reason: fmt.Sprintf("bitfield of %d bytes for %d pieces", len(bf), c.numPieces)}
+	}
+	for index := c.numPieces; index < len(bf)*8; index++ {
+		if bf.HasPiece(index) {
+			return &ProtocolError{Peer: c.peer.String(), Reason: "spare bits set in bitfield"}
+		}
 	}
-	return msg.Payload, nil
+	return nil
 }
 
-func CliantConnector(peer Peer, peerID, infoHash [20]byte) (*Client, error) {
+// CliantConnector connects to a peer and exchanges handshakes and
+// bitfields with it. bf holds the pieces we have out of numPieces.
+func CliantConnector(peer Peer, peerID, infoHash [20]byte, extensions *ExtensionRegistry, bf Bitfield, numPieces int) (*Client, error) {
 	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
 	if err != nil {
 		return nil, err
 	}
-	_, err = completeHandShake(conn, infoHash, peerID)
+	res, err := completeHandShake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
-	bf, err := recvBitfield(conn)
+
+	client := &Client{
+		Conn:               conn,
+		Choked:             true,
+		peer:               peer,
+		infoHash:           infoHash,
+		peerID:             peerID,
+		remoteID:           res.PeerID,
+		numPieces:          numPieces,
+		supportsFast:       res.SupportsFast(),
+		supportsExtensions: res.SupportsExtensions(),
+		extensions:         extensions,
+	}
+	if err := client.sendExtendedHandshake(); err != nil {
+		client.close()
+		return nil, err
+	}
+	if err := client.sendPieces(bf); err != nil {
+		client.close()
+		return nil, err
+	}
+	remoteBF, err := client.recvBitfield()
 	if err != nil {
-		conn.Close()
+		client.close()
 		return nil, err
 	}
+	client.Bitfield = remoteBF
+
+	return client, nil
+}
+
+// close closes the connection and tells everyone waiting on closedSignal
+// that it is done with
+func (c *Client) close() {
+	c.Conn.Close()
+	closed := c.closedSignal()
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+	select {
+	case <-closed:
+	default:
+		close(closed)
+	}
+}
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+func (c *Client) closedSignal() chan struct{} {
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	return c.closed
 }
 
 // Read reads and consumes a message from the connection
 func (c *Client) Read() (*Message, error) {
-	msg, err := messageReader(c.Conn)
+	msg, err := messageReader(c.bufReader())
 	return msg, err
 }
 
+// bufReader buffers the connection. Only the goroutine reading the
+// connection may call it.
+func (c *Client) bufReader() *bufio.Reader {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.Conn)
+	}
+	return c.reader
+}
+
+// waitMessage waits up to timeout for the peer to send something. It
+// reports whether data has arrived, nothing is consumed.
+func (c *Client) waitMessage(timeout time.Duration) (bool, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	_, err := c.bufReader().Peek(1)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // SendRequest sends a Request message to the peer
 func (c *Client) SendRequest(index, begin, length int) error {
 	req := createRequestMessage(index, begin, length)
@@ -84,6 +213,14 @@ func (c *Client) SendRequest(index, begin, length int) error {
 	return err
 }
 
+// SendCancel sends a Cancel message for a block we requested before
+func (c *Client) SendCancel(index, begin, length int) error {
+	msg := createRequestMessage(index, begin, length)
+	msg.ID = MsgCancel
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 // SendInterested sends an Interested message to the peer
 func (c *Client) SendInterested() error {
 	msg := Message{ID: MsgInterested}
@@ -100,11 +237,45 @@ func (c *Client) SendNotInterested() error {
 
 // SendUnchoke sends an Unchoke message to the peer
 func (c *Client) SendUnchoke() error {
+	c.uploadMu.Lock()
+	c.peerUnchoked = true
+	c.uploadMu.Unlock()
 	msg := Message{ID: MsgUnchoke}
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
 
+// SendChoke sends a Choke message to the peer and drops its pending
+// requests. A fast peer keeps its requests for allowed fast pieces and is
+// told about the dropped ones.
+func (c *Client) SendChoke() error {
+	c.uploadMu.Lock()
+	c.peerUnchoked = false
+	var kept, dropped []blockRequest
+	for _, req := range c.uploads {
+		if c.supportsFast && c.allowedFastOut[req.index] {
+			kept = append(kept, req)
+		} else {
+			dropped = append(dropped, req)
+		}
+	}
+	c.uploads = kept
+	c.uploadMu.Unlock()
+	msg := Message{ID: MsgChoke}
+	if _, err := c.Conn.Write(msg.Serialize()); err != nil {
+		return err
+	}
+	c.rejectRequests(dropped)
+	return nil
+}
+
+// SendPiece sends a block of a piece to the peer
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	msg := createPieceMessage(index, begin, block)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 // SendHave sends a Have message to the peer
 func (c *Client) SendHave(index int) error {
 	msg := getMwssageFormat(index)
@@ -112,13 +283,23 @@ func (c *Client) SendHave(index int) error {
 	return err
 }
 
+// SendBitfield sends a Bitfield message to the peer
+func (c *Client) SendBitfield(bf Bitfield) error {
+	msg := Message{ID: MsgBitfield, Payload: bf}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 // New Creates a new handshake with the standard pstr
 func handshakeWithPeer(infoHash, peerID [20]byte) *HandShake {
-	return &HandShake{
-		Pstr:     "BitTorrent protocol",
+	h := &HandShake{
+		Pstr:     protocolName,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.Reserved[5] |= extensionBit
+	h.Reserved[7] |= fastBit
+	return h
 }
 
 func (h *HandShake) Serialize() []byte {
@@ -126,7 +307,7 @@ func (h *HandShake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -145,14 +326,20 @@ func handshakeMaker(r io.Reader) (*HandShake, error) {
 	}
 	handshakeBuf := make([]byte, 48+pstrlen)
 	_, err = io.ReadFull(r, handshakeBuf)
+	if err != nil {
+		return nil, err
+	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := HandShake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -211,6 +398,18 @@ func (m *Message) messageName() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
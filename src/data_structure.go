@@ -1,6 +1,12 @@
 package leecher
 
-import "net"
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // message
 type messageID uint8
@@ -15,6 +21,12 @@ const (
 	MsgRequest       messageID = 6
 	MsgPiece         messageID = 7
 	MsgCancel        messageID = 8
+	MsgSuggest       messageID = 13
+	MsgHaveAll       messageID = 14
+	MsgHaveNone      messageID = 15
+	MsgReject        messageID = 16
+	MsgAllowedFast   messageID = 17
+	MsgExtended      messageID = 20
 )
 
 type Message struct {
@@ -22,14 +34,24 @@ type Message struct {
 	Payload []byte
 }
 
+// File is one file of a torrent. Path is relative to the download
+// directory and Offset is where the file starts in the torrent's data.
+type File struct {
+	Path   []string
+	Length int
+	Offset int
+}
+
 // TorrentFile encodes the metadata from a .torrent file
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Announce     string
+	AnnounceList [][]string
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Files        []File
 }
 
 // Torrent holds data required to download a torrent from a list of peers
@@ -41,21 +63,102 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Storage     TorrentStorage
+	Extensions  *ExtensionRegistry
+	// UploadSlots is how many peers the choker unchokes for their rate,
+	// DefaultUploadSlots if zero. One optimistic unchoke comes on top.
+	UploadSlots int
+	// MinPeers is how many connections Download tries to keep,
+	// DefaultMinPeers if zero
+	MinPeers int
+	// StallTimeout is how long Download waits for data before it gives
+	// up, DefaultStallTimeout if zero
+	StallTimeout time.Duration
+
+	peerMu       sync.Mutex
+	pendingPeers []Peer
+	pendingConns []*Client
+	accepting    bool
+	peerNotify   chan struct{}
+	connected    map[[20]byte]*Client
+	done         chan struct{}
+	chokeNotify  chan struct{}
+	wantPeers    chan struct{}
+	// workers counts the goroutines that use the connections and storage
+	// of the torrent, see goWorker
+	workers sync.WaitGroup
+	// conns, downloadLimit and uploadLimit are shared with the other
+	// torrents of a Session, nil means unlimited
+	conns         *connBudget
+	downloadLimit *rateLimiter
+	uploadLimit   *rateLimiter
+	downloaded    atomic.Int64
+	uploaded      atomic.Int64
 }
 
 // clianrt object
 type Client struct {
 	Conn     net.Conn
+	reader   *bufio.Reader
 	Choked   bool
 	Bitfield Bitfield
 	peer     Peer
 	infoHash [20]byte
 	peerID   [20]byte
+	remoteID [20]byte
+	// incoming is set when the peer connected to us, peer.Port is then
+	// not the port it listens on
+	incoming bool
+	// numPieces is the number of pieces of the torrent
+	numPieces int
+
+	// supportsFast is set when both sides speak the fast extension.
+	// allowedFast holds the pieces the peer lets us request while it
+	// chokes us and suggested the pieces it hinted at, both are only
+	// touched by the goroutine reading the connection.
+	supportsFast bool
+	allowedFast  map[int]bool
+	suggested    []int
+
+	supportsExtensions bool
+	extensions         *ExtensionRegistry
+	extMu              sync.Mutex
+	remoteExtensions   map[string]int
+	// remoteMetadataSize is the size of the info dictionary the peer
+	// announced in its extended handshake, 0 if it didn't
+	remoteMetadataSize int
+
+	// uploadMu guards the uploading side of the connection
+	uploadMu       sync.Mutex
+	peerUnchoked   bool
+	peerInterested bool
+	uploads        []blockRequest
+	uploadNotify   chan struct{}
+	// allowedFastOut holds the pieces the peer may request while we choke
+	// it
+	allowedFastOut map[int]bool
+	// interestNotify is the choker's signal of the torrent
+	interestNotify chan struct{}
+
+	// closed is closed once the connection is done with, see close
+	closed chan struct{}
+
+	// downloadLimit is the download rate limit of the torrent, only the
+	// goroutine reading the connection uses it
+	downloadLimit *rateLimiter
+	// finished is the doneSignal of the torrent, it interrupts a wait for
+	// downloadLimit
+	finished <-chan struct{}
+
+	// bytes received from and sent to the peer, for the choker
+	downloadedBytes atomic.Int64
+	uploadedBytes   atomic.Int64
 }
 
 // A Handshake is a special message that a peer uses to identify itself
 type HandShake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
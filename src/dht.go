@@ -0,0 +1,735 @@
+package leecher
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dhtQueryTimeout = 2 * time.Second
+	// dhtAlpha is how many queries a lookup keeps in flight
+	dhtAlpha = 3
+	// dhtMaxLookupRounds bounds an iterative lookup
+	dhtMaxLookupRounds = 16
+	// dhtSecretRotation is how often the token secret changes. Tokens of
+	// the previous secret stay valid, so a token lives up to twice as long.
+	dhtSecretRotation = 5 * time.Minute
+	// dhtPeerLifetime is how long an announced peer is remembered
+	dhtPeerLifetime = 30 * time.Minute
+	// dhtMaxValues caps the peers returned for one get_peers
+	dhtMaxValues = 50
+	// dhtLookupInterval is how often a download asks the DHT for peers
+	dhtLookupInterval = 5 * time.Minute
+)
+
+// DefaultBootstrapNodes are well known routers of the mainline DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var (
+	errDHTTimeout = errors.New("dht query timed out")
+	errDHTClosed  = errors.New("dht node closed")
+)
+
+// KRPC error codes
+const (
+	krpcGenericError  = 201
+	krpcProtocolError = 203
+	krpcUnknownMethod = 204
+)
+
+// krpcMessage is a decoded KRPC message. Only the part matching Y is set.
+type krpcMessage struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q"`
+	A krpcArgs      `bencode:"a"`
+	R krpcResponse  `bencode:"r"`
+	E []interface{} `bencode:"e"`
+}
+
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target"`
+	InfoHash    string `bencode:"info_hash"`
+	Port        int    `bencode:"port"`
+	ImpliedPort int    `bencode:"implied_port"`
+	Token       string `bencode:"token"`
+}
+
+type krpcResponse struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes"`
+	Values []string `bencode:"values"`
+	Token  string   `bencode:"token"`
+}
+
+type bencodeDHTState struct {
+	Nodes string `bencode:"nodes"`
+}
+
+type pendingQuery struct {
+	addr string
+	ch   chan *krpcMessage
+}
+
+type storedPeer struct {
+	peer    Peer
+	expires time.Time
+}
+
+// DHT is a node of the mainline DHT (BEP 5). It answers queries from other
+// nodes and finds peers for infohashes without a tracker.
+type DHT struct {
+	conn  net.PacketConn
+	id    [20]byte
+	table *routingTable
+
+	mu         sync.Mutex
+	nextTx     uint16
+	pending    map[string]pendingQuery
+	peers      map[[20]byte]map[string]storedPeer
+	secret     [20]byte
+	prevSecret [20]byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDHT starts a DHT node listening on the UDP address addr, for example
+// ":6881" or "127.0.0.1:0"
+func NewDHT(addr string) (*DHT, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	id, err := generatePeerID()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d := &DHT{
+		conn:    conn,
+		id:      id,
+		table:   newRoutingTable(id),
+		pending: make(map[string]pendingQuery),
+		peers:   make(map[[20]byte]map[string]storedPeer),
+		done:    make(chan struct{}),
+	}
+	if _, err := rand.Read(d.secret[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.prevSecret = d.secret
+
+	go d.readLoop()
+	go d.maintain()
+	return d, nil
+}
+
+// Addr is the local address of the node
+func (d *DHT) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// ID is the node ID
+func (d *DHT) ID() [20]byte {
+	return d.id
+}
+
+// NumNodes is the number of nodes in the routing table
+func (d *DHT) NumNodes() int {
+	return d.table.size()
+}
+
+// Close stops the node
+func (d *DHT) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		err = d.conn.Close()
+	})
+	return err
+}
+
+// Bootstrap joins the DHT through the given host:port nodes and fills the
+// routing table with a lookup of our own ID
+func (d *DHT) Bootstrap(addrs []string) error {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			log.Printf("Could not resolve DHT node %s: %v\n", addr, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.findNode(udpAddr, d.id)
+		}()
+	}
+	wg.Wait()
+
+	d.lookup(d.id, "find_node")
+	if d.table.size() == 0 {
+		return errors.New("no DHT node answered")
+	}
+	return nil
+}
+
+// GetPeers looks up peers for an infohash
+func (d *DHT) GetPeers(infoHash [20]byte) ([]Peer, error) {
+	peers, _ := d.lookup(infoHash, "get_peers")
+	if len(peers) == 0 && d.table.size() == 0 {
+		return nil, errors.New("dht routing table is empty")
+	}
+	return peers, nil
+}
+
+// Announce looks up an infohash and tells the closest nodes that we accept
+// connections for it on port. It returns the peers found on the way.
+func (d *DHT) Announce(infoHash [20]byte, port uint16) ([]Peer, error) {
+	peers, tokens := d.lookup(infoHash, "get_peers")
+	if len(tokens) == 0 {
+		return peers, errors.New("no DHT node handed out a token")
+	}
+	var wg sync.WaitGroup
+	for _, tn := range tokens {
+		wg.Add(1)
+		go func(tn tokenNode) {
+			defer wg.Done()
+			d.query(tn.addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(infoHash[:]),
+				"port":      int(port),
+				"token":     tn.token,
+			})
+		}(tn)
+	}
+	wg.Wait()
+	return peers, nil
+}
+
+// LoadNodes adds the nodes saved by SaveNodes to the routing table
+func (d *DHT) LoadNodes(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	state := bencodeDHTState{}
+	if err := UnmarshalResponse(file, &state); err != nil {
+		return err
+	}
+	nodes, err := unmarshalNodes([]byte(state.Nodes))
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		d.table.insert(n.id, n.addr)
+	}
+	return nil
+}
+
+// SaveNodes writes the good nodes of the routing table to path so the next
+// run can skip most of the bootstrap
+func (d *DHT) SaveNodes(path string) error {
+	nodes := d.table.closest(d.id, 160*dhtK)
+	var buf bytes.Buffer
+	err := DescodeMarshal(&buf, bencodeDHTState{Nodes: string(marshalNodes(nodes))})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// dhtNodesPath is where the routing table is kept between runs
+func dhtNodesPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "leecher", "dht.nodes"), nil
+}
+
+// startDHT starts a node on port with the nodes saved by the last run. It
+// returns nil when the node can't be started, downloads then only use
+// their trackers.
+func startDHT(port uint16) *DHT {
+	d, err := NewDHT(fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Println("Could not start DHT:", err)
+		return nil
+	}
+	if path, err := dhtNodesPath(); err == nil {
+		if err := d.LoadNodes(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("Could not load DHT nodes:", err)
+		}
+	}
+	return d
+}
+
+// shutdown saves the routing table for the next run and closes the node
+func (d *DHT) shutdown() {
+	if path, err := dhtNodesPath(); err == nil && d.NumNodes() > 0 {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = d.SaveNodes(path)
+		}
+		if err != nil {
+			log.Println("Could not save DHT nodes:", err)
+		}
+	}
+	d.Close()
+}
+
+// feedPeers looks the torrent up every dhtLookupInterval, announces us and
+// hands the peers found to the download until stop is closed. A node with
+// an empty routing table joins through DefaultBootstrapNodes first.
+func (d *DHT) feedPeers(t *Torrent, port uint16, stop <-chan struct{}) {
+	if d.NumNodes() == 0 {
+		if err := d.Bootstrap(DefaultBootstrapNodes); err != nil {
+			log.Println("DHT bootstrap failed:", err)
+		}
+	}
+	ticker := time.NewTicker(dhtLookupInterval)
+	defer ticker.Stop()
+	for {
+		peers, err := d.Announce(t.InfoHash, port)
+		if err != nil {
+			log.Println("DHT announce failed:", err)
+		}
+		if len(peers) > 0 {
+			log.Printf("DHT returned %d peers\n", len(peers))
+			t.AddPeers(peers)
+		}
+		select {
+		case <-stop:
+			return
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type tokenNode struct {
+	addr  *net.UDPAddr
+	token string
+}
+
+type lookupCandidate struct {
+	node    dhtNode
+	queried bool
+	alive   bool
+	token   string
+}
+
+// lookup runs an iterative find_node or get_peers towards target. It
+// returns the peers found and the tokens of the closest nodes that answered.
+func (d *DHT) lookup(target [20]byte, method string) ([]Peer, []tokenNode) {
+	candidates := make(map[string]*lookupCandidate)
+	add := func(n dhtNode) {
+		if n.id == d.id || n.addr == nil {
+			return
+		}
+		if _, ok := candidates[n.addr.String()]; !ok {
+			candidates[n.addr.String()] = &lookupCandidate{node: n}
+		}
+	}
+	for _, n := range d.table.closest(target, dhtK) {
+		add(n)
+	}
+
+	var peers []Peer
+	for round := 0; round < dhtMaxLookupRounds; round++ {
+		// The dhtK closest candidates that have not failed
+		var closest []*lookupCandidate
+		for _, c := range candidates {
+			if !c.queried || c.alive {
+				closest = append(closest, c)
+			}
+		}
+		sort.Slice(closest, func(i, j int) bool {
+			return closerTo(target, closest[i].node.id, closest[j].node.id)
+		})
+		if len(closest) > dhtK {
+			closest = closest[:dhtK]
+		}
+
+		var batch []*lookupCandidate
+		for _, c := range closest {
+			if !c.queried && len(batch) < dhtAlpha {
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		responses := make([]*krpcMessage, len(batch))
+		var wg sync.WaitGroup
+		for i, c := range batch {
+			c.queried = true
+			wg.Add(1)
+			go func(i int, c *lookupCandidate) {
+				defer wg.Done()
+				key := "target"
+				if method == "get_peers" {
+					key = "info_hash"
+				}
+				resp, err := d.query(c.node.addr, method, map[string]interface{}{
+					key: string(target[:]),
+				})
+				if err == nil {
+					responses[i] = resp
+				}
+			}(i, c)
+		}
+		wg.Wait()
+
+		for i, resp := range responses {
+			if resp == nil {
+				continue
+			}
+			batch[i].alive = true
+			batch[i].token = resp.R.Token
+			nodes, err := unmarshalNodes([]byte(resp.R.Nodes))
+			if err == nil {
+				for _, n := range nodes {
+					add(n)
+				}
+			}
+			peers = append(peers, unmarshalValues(resp.R.Values)...)
+		}
+	}
+
+	var answered []*lookupCandidate
+	for _, c := range candidates {
+		if c.alive && c.token != "" {
+			answered = append(answered, c)
+		}
+	}
+	sort.Slice(answered, func(i, j int) bool {
+		return closerTo(target, answered[i].node.id, answered[j].node.id)
+	})
+	if len(answered) > dhtK {
+		answered = answered[:dhtK]
+	}
+	tokens := make([]tokenNode, len(answered))
+	for i, c := range answered {
+		tokens[i] = tokenNode{addr: c.node.addr, token: c.token}
+	}
+	return dedupePeers(peers), tokens
+}
+
+// unmarshalValues decodes the compact peers of a get_peers response
+func unmarshalValues(values []string) []Peer {
+	var peers []Peer
+	for _, v := range values {
+		var found []Peer
+		var err error
+		switch len(v) {
+		case peerSize:
+			found, err = unmarshalPeers([]byte(v))
+		case peer6Size:
+			found, err = unmarshalPeers6([]byte(v))
+		default:
+			continue
+		}
+		if err == nil {
+			peers = append(peers, found...)
+		}
+	}
+	return peers
+}
+
+func (d *DHT) findNode(addr *net.UDPAddr, target [20]byte) ([]dhtNode, error) {
+	resp, err := d.query(addr, "find_node", map[string]interface{}{
+		"target": string(target[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := unmarshalNodes([]byte(resp.R.Nodes))
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		d.table.insert(n.id, n.addr)
+	}
+	return nodes, nil
+}
+
+// ping checks that a node is alive
+func (d *DHT) ping(addr *net.UDPAddr) error {
+	_, err := d.query(addr, "ping", map[string]interface{}{})
+	return err
+}
+
+// query sends a KRPC query and waits for the answer
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (*krpcMessage, error) {
+	args["id"] = string(d.id[:])
+
+	d.mu.Lock()
+	d.nextTx++
+	tx := string([]byte{byte(d.nextTx >> 8), byte(d.nextTx)})
+	ch := make(chan *krpcMessage, 1)
+	d.pending[tx] = pendingQuery{addr: addr.String(), ch: ch}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, tx)
+		d.mu.Unlock()
+	}()
+
+	err := d.send(addr, map[string]interface{}{
+		"t": tx,
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(dhtQueryTimeout)
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		if resp.Y == "e" {
+			return nil, fmt.Errorf("dht node %s: error %v", addr, resp.E)
+		}
+		return resp, nil
+	case <-timer.C:
+		d.table.failed(addr)
+		return nil, errDHTTimeout
+	case <-d.done:
+		return nil, errDHTClosed
+	}
+}
+
+func (d *DHT) send(addr net.Addr, msg map[string]interface{}) error {
+	var buf bytes.Buffer
+	if err := DescodeMarshal(&buf, msg); err != nil {
+		return err
+	}
+	_, err := d.conn.WriteTo(buf.Bytes(), addr)
+	return err
+}
+
+func (d *DHT) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			log.Println("DHT read failed:", err)
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		msg := &krpcMessage{}
+		if err := UnmarshalResponse(bytes.NewReader(buf[:n]), msg); err != nil {
+			continue // not a KRPC message
+		}
+		switch msg.Y {
+		case "q":
+			d.handleQuery(msg, udpAddr)
+		case "r", "e":
+			d.handleResponse(msg, udpAddr)
+		}
+	}
+}
+
+func (d *DHT) handleResponse(msg *krpcMessage, addr *net.UDPAddr) {
+	d.mu.Lock()
+	pq, ok := d.pending[msg.T]
+	d.mu.Unlock()
+	if !ok || pq.addr != addr.String() {
+		return // late, unknown or spoofed
+	}
+	if msg.Y == "r" && len(msg.R.ID) == 20 {
+		var id [20]byte
+		copy(id[:], msg.R.ID)
+		d.table.insert(id, addr)
+	}
+	select {
+	case pq.ch <- msg:
+	default:
+	}
+}
+
+func (d *DHT) handleQuery(msg *krpcMessage, addr *net.UDPAddr) {
+	if len(msg.A.ID) != 20 {
+		d.sendError(msg.T, addr, krpcProtocolError, "invalid id")
+		return
+	}
+	var id [20]byte
+	copy(id[:], msg.A.ID)
+	d.table.insert(id, addr)
+
+	reply := map[string]interface{}{"id": string(d.id[:])}
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		if len(msg.A.Target) != 20 {
+			d.sendError(msg.T, addr, krpcProtocolError, "invalid target")
+			return
+		}
+		var target [20]byte
+		copy(target[:], msg.A.Target)
+		reply["nodes"] = string(marshalNodes(d.table.closest(target, dhtK)))
+	case "get_peers":
+		if len(msg.A.InfoHash) != 20 {
+			d.sendError(msg.T, addr, krpcProtocolError, "invalid info_hash")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		reply["token"] = string(d.token(addr.IP, d.currentSecret()))
+		if values := d.storedValues(infoHash); len(values) > 0 {
+			reply["values"] = values
+		} else {
+			reply["nodes"] = string(marshalNodes(d.table.closest(infoHash, dhtK)))
+		}
+	case "announce_peer":
+		if len(msg.A.InfoHash) != 20 {
+			d.sendError(msg.T, addr, krpcProtocolError, "invalid info_hash")
+			return
+		}
+		if !d.validToken(msg.A.Token, addr.IP) {
+			d.sendError(msg.T, addr, krpcProtocolError, "bad token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(msg.T, addr, krpcProtocolError, "invalid port")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		d.storePeer(infoHash, Peer{IP: addr.IP, Port: uint16(port)})
+	default:
+		d.sendError(msg.T, addr, krpcUnknownMethod, "method unknown")
+		return
+	}
+
+	d.send(addr, map[string]interface{}{
+		"t": msg.T,
+		"y": "r",
+		"r": reply,
+	})
+}
+
+func (d *DHT) sendError(tx string, addr *net.UDPAddr, code int, message string) {
+	d.send(addr, map[string]interface{}{
+		"t": tx,
+		"y": "e",
+		"e": []interface{}{code, message},
+	})
+}
+
+func (d *DHT) currentSecret() [20]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.secret
+}
+
+// token is handed out with get_peers and proves in announce_peer that the
+// announcing node owns its IP address
+func (d *DHT) token(ip net.IP, secret [20]byte) []byte {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip)
+	return h.Sum(nil)
+}
+
+func (d *DHT) validToken(token string, ip net.IP) bool {
+	d.mu.Lock()
+	secret, prev := d.secret, d.prevSecret
+	d.mu.Unlock()
+	return token == string(d.token(ip, secret)) || token == string(d.token(ip, prev))
+}
+
+func (d *DHT) storePeer(infoHash [20]byte, peer Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.peers[infoHash] == nil {
+		d.peers[infoHash] = make(map[string]storedPeer)
+	}
+	d.peers[infoHash][peer.String()] = storedPeer{peer: peer, expires: time.Now().Add(dhtPeerLifetime)}
+}
+
+// storedValues returns the peers announced for infoHash in compact form
+func (d *DHT) storedValues(infoHash [20]byte) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var values []string
+	for _, sp := range d.peers[infoHash] {
+		if len(values) >= dhtMaxValues {
+			break
+		}
+		values = append(values, string(sp.peer.compact()))
+	}
+	return values
+}
+
+// maintain rotates the token secret and forgets expired peers
+func (d *DHT) maintain() {
+	ticker := time.NewTicker(dhtSecretRotation)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		var secret [20]byte
+		if _, err := rand.Read(secret[:]); err != nil {
+			continue
+		}
+		d.mu.Lock()
+		d.prevSecret, d.secret = d.secret, secret
+		now := time.Now()
+		for infoHash, peers := range d.peers {
+			for key, sp := range peers {
+				if now.After(sp.expires) {
+					delete(peers, key)
+				}
+			}
+			if len(peers) == 0 {
+				delete(d.peers, infoHash)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
@@ -0,0 +1,195 @@
+package leecher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// dhtK is the size of a bucket and of every lookup result
+	dhtK = 8
+	// dhtNodeStale is how long a node may stay silent before it can be
+	// replaced by a new one
+	dhtNodeStale = 15 * time.Minute
+	// dhtMaxFailures is how many queries in a row a node may miss
+	dhtMaxFailures = 2
+	// compactNodeSize is the size of an IPv4 compact node info
+	compactNodeSize = 26
+)
+
+type dhtNode struct {
+	id       [20]byte
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+func (n *dhtNode) bad() bool {
+	return n.failures >= dhtMaxFailures || time.Since(n.lastSeen) > dhtNodeStale
+}
+
+// routingTable keeps up to dhtK nodes per bucket. Bucket i holds the nodes
+// whose ID shares exactly i leading bits with ours.
+type routingTable struct {
+	mu      sync.Mutex
+	self    [20]byte
+	buckets [160][]*dhtNode
+}
+
+func newRoutingTable(self [20]byte) *routingTable {
+	return &routingTable{self: self}
+}
+
+// xorDistance is the Kademlia distance between two IDs
+func xorDistance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closerTo reports whether a is closer to target than b
+func closerTo(target, a, b [20]byte) bool {
+	da, db := xorDistance(target, a), xorDistance(target, b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+func (rt *routingTable) bucketIndex(id [20]byte) int {
+	d := xorDistance(rt.self, id)
+	for i, b := range d {
+		for bit := 0; bit < 8; bit++ {
+			if b&(0x80>>bit) != 0 {
+				return i*8 + bit
+			}
+		}
+	}
+	return -1 // our own ID
+}
+
+// insert adds a node we heard from or refreshes it. A full bucket only
+// takes the node if one of its entries has gone bad.
+func (rt *routingTable) insert(id [20]byte, addr *net.UDPAddr) {
+	index := rt.bucketIndex(id)
+	if index < 0 || addr == nil || addr.Port == 0 {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	bucket := rt.buckets[index]
+	for i, n := range bucket {
+		if n.id == id {
+			n.addr = addr
+			n.lastSeen = time.Now()
+			n.failures = 0
+			// Most recently seen nodes live at the end
+			rt.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return
+		}
+	}
+
+	node := &dhtNode{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < dhtK {
+		rt.buckets[index] = append(bucket, node)
+		return
+	}
+	for i, n := range bucket {
+		if n.bad() {
+			bucket[i] = node
+			return
+		}
+	}
+}
+
+// failed records that a node did not answer and drops it once it has
+// failed too often
+func (rt *routingTable) failed(addr *net.UDPAddr) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for index, bucket := range rt.buckets {
+		for i, n := range bucket {
+			if n.addr.String() != addr.String() {
+				continue
+			}
+			n.failures++
+			if n.failures >= dhtMaxFailures {
+				rt.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to count good nodes ordered by distance to target
+func (rt *routingTable) closest(target [20]byte, count int) []dhtNode {
+	rt.mu.Lock()
+	var nodes []dhtNode
+	for _, bucket := range rt.buckets {
+		for _, n := range bucket {
+			if n.failures < dhtMaxFailures {
+				nodes = append(nodes, *n)
+			}
+		}
+	}
+	rt.mu.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return closerTo(target, nodes[i].id, nodes[j].id)
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// size is the number of nodes in the table
+func (rt *routingTable) size() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	size := 0
+	for _, bucket := range rt.buckets {
+		size += len(bucket)
+	}
+	return size
+}
+
+// marshalNodes encodes IPv4 nodes in the compact node info format. Nodes
+// with other addresses are skipped.
+func marshalNodes(nodes []dhtNode) []byte {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(n.addr.Port))
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, ip...)
+		buf = append(buf, port[:]...)
+	}
+	return buf
+}
+
+// unmarshalNodes decodes compact node info
+func unmarshalNodes(buf []byte) ([]dhtNode, error) {
+	if len(buf)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("received malformed nodes")
+	}
+	nodes := make([]dhtNode, len(buf)/compactNodeSize)
+	for i := range nodes {
+		entry := buf[i*compactNodeSize : (i+1)*compactNodeSize]
+		copy(nodes[i].id[:], entry[0:20])
+		nodes[i].addr = &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), entry[20:24]...)),
+			Port: int(binary.BigEndian.Uint16(entry[24:26])),
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,72 @@
+package leecher
+
+import (
+	"crypto/sha1"
+	"testing"
+)
+
+// startTestDHT starts n nodes on the loopback interface. Every node but the
+// first bootstraps from the nodes started before it.
+func startTestDHT(t *testing.T, n int) []*DHT {
+	t.Helper()
+	var nodes []*DHT
+	var addrs []string
+	for i := 0; i < n; i++ {
+		d, err := NewDHT("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		if i > 0 {
+			if err := d.Bootstrap(addrs); err != nil {
+				t.Fatalf("node %d: %v", i, err)
+			}
+		}
+		nodes = append(nodes, d)
+		addrs = append(addrs, d.Addr().String())
+	}
+	return nodes
+}
+
+func TestDHTBootstrap(t *testing.T) {
+	nodes := startTestDHT(t, 6)
+	if got := nodes[0].NumNodes(); got != len(nodes)-1 {
+		t.Errorf("first node knows %d nodes, want %d", got, len(nodes)-1)
+	}
+	for i, d := range nodes[1:] {
+		if d.NumNodes() == 0 {
+			t.Errorf("node %d has an empty routing table", i+1)
+		}
+	}
+}
+
+func TestDHTAnnounceGetPeers(t *testing.T) {
+	nodes := startTestDHT(t, 6)
+	infoHash := sha1.Sum([]byte("dht test"))
+
+	if _, err := nodes[2].Announce(infoHash, 4242); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := nodes[5].GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, peer := range peers {
+		if peer.IP.IsLoopback() && peer.Port == 4242 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("get_peers returned %v, want the announced peer on port 4242", peers)
+	}
+
+	other := sha1.Sum([]byte("not announced"))
+	peers, err = nodes[4].GetPeers(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Errorf("get_peers for an unknown infohash returned %v", peers)
+	}
+}
@@ -0,0 +1,231 @@
+package leecher
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// extensionBit is set in reserved byte 5 by peers that speak the extension
+// protocol (BEP 10)
+const extensionBit = 0x10
+
+// extendedHandshakeID is the extended message ID of the extended handshake
+const extendedHandshakeID = 0
+
+// extendedHandshake is the bencoded payload of the extended handshake. M
+// maps extension names to the message IDs the sender wants to receive them
+// on.
+type extendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	Version      string         `bencode:"v,omitempty"`
+}
+
+// clientVersion is sent as "v" in our extended handshake
+const clientVersion = "leecher"
+
+// ErrExtensionNotSupported is returned when sending an extended message the
+// peer did not announce in its extended handshake
+var ErrExtensionNotSupported = errors.New("extension not supported by peer")
+
+// SupportsExtensions reports whether the peer set the extension protocol bit
+func (h *HandShake) SupportsExtensions() bool {
+	return h.Reserved[5]&extensionBit != 0
+}
+
+// ExtensionHandler implements one extension of the extension protocol,
+// such as ut_metadata or ut_pex
+type ExtensionHandler interface {
+	// Name is the key of the extension in the "m" dictionary
+	Name() string
+	// HandleHandshake is called once the extended handshake of a peer has
+	// arrived. The peer may not support this extension, see
+	// Client.SupportsExtension.
+	HandleHandshake(c *Client) error
+	// HandleMessage is called with the payload of every extended message
+	// the peer sends for this extension
+	HandleMessage(c *Client, payload []byte) error
+}
+
+// ExtensionRegistry holds the extensions we offer to peers. The local
+// message ID of an extension is its position in the registry plus one.
+type ExtensionRegistry struct {
+	mu       sync.RWMutex
+	handlers []ExtensionHandler
+}
+
+// NewExtensionRegistry creates an empty registry
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{}
+}
+
+// Register adds an extension. Peers connected afterwards will be offered it.
+func (r *ExtensionRegistry) Register(h ExtensionHandler) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.handlers {
+		if existing.Name() == h.Name() {
+			return fmt.Errorf("extension %s is already registered", h.Name())
+		}
+	}
+	if len(r.handlers) >= 255 {
+		return errors.New("too many extensions")
+	}
+	r.handlers = append(r.handlers, h)
+	return nil
+}
+
+// handler returns the extension registered for a local message ID or nil
+func (r *ExtensionRegistry) handler(id uint8) ExtensionHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if id == extendedHandshakeID || int(id) > len(r.handlers) {
+		return nil
+	}
+	return r.handlers[id-1]
+}
+
+// all returns a snapshot of the registered extensions
+func (r *ExtensionRegistry) all() []ExtensionHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]ExtensionHandler(nil), r.handlers...)
+}
+
+// handshake builds our extended handshake from the registered extensions
+func (r *ExtensionRegistry) handshake() extendedHandshake {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	hs := extendedHandshake{
+		M:       make(map[string]int, len(r.handlers)),
+		Version: clientVersion,
+	}
+	for i, h := range r.handlers {
+		hs.M[h.Name()] = i + 1
+	}
+	return hs
+}
+
+// sendExtendedHandshake sends our extended handshake if the peer supports
+// the extension protocol
+func (c *Client) sendExtendedHandshake() error {
+	if !c.supportsExtensions || c.extensions == nil {
+		return nil
+	}
+	msg, err := createExtendedHandshake(c.extensions.handshake())
+	if err != nil {
+		return err
+	}
+	_, err = c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SupportsExtension reports whether the peer announced the named extension
+// in its extended handshake
+func (c *Client) SupportsExtension(name string) bool {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	return c.remoteExtensions[name] != 0
+}
+
+// metadataSize is the size of the info dictionary the peer announced in
+// its extended handshake
+func (c *Client) metadataSize() int {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	return c.remoteMetadataSize
+}
+
+// SendExtended sends payload to the peer as a message of the named extension
+func (c *Client) SendExtended(name string, payload []byte) error {
+	c.extMu.Lock()
+	id := c.remoteExtensions[name]
+	c.extMu.Unlock()
+	if id == 0 {
+		return fmt.Errorf("%s: %w", name, ErrExtensionNotSupported)
+	}
+	msg := createExtendedMessage(uint8(id), payload)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// handleExtended dispatches an EXTENDED message to the registered
+// extensions. Messages for unknown extensions are dropped.
+func (c *Client) handleExtended(msg *Message) error {
+	id, payload, err := parseExtendedMessage(msg)
+	if err != nil {
+		return err
+	}
+	if c.extensions == nil {
+		return nil
+	}
+
+	if id == extendedHandshakeID {
+		hs, err := parseExtendedHandshake(payload)
+		if err != nil {
+			return fmt.Errorf("malformed extended handshake: %w", err)
+		}
+		c.extMu.Lock()
+		c.remoteMetadataSize = hs.MetadataSize
+		c.remoteExtensions = make(map[string]int, len(hs.M))
+		for name, remoteID := range hs.M {
+			// An ID of 0 means the peer disabled the extension
+			if remoteID > 0 && remoteID < 256 {
+				c.remoteExtensions[name] = remoteID
+			}
+		}
+		c.extMu.Unlock()
+		for _, h := range c.extensions.all() {
+			if err := h.HandleHandshake(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	h := c.extensions.handler(id)
+	if h == nil {
+		log.Printf("Ignoring unknown extended message %d from %s\n", id, c.peer)
+		return nil
+	}
+	return h.HandleMessage(c, payload)
+}
+
+// createExtendedMessage creates an EXTENDED message
+func createExtendedMessage(id uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// parseExtendedMessage splits an EXTENDED message into its extended message
+// ID and payload
+func parseExtendedMessage(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("expected extended (ID %d), got id %d", MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("extended message without an ID")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// createExtendedHandshake creates the extended handshake message
+func createExtendedHandshake(hs extendedHandshake) (*Message, error) {
+	var buf bytes.Buffer
+	if err := DescodeMarshal(&buf, hs); err != nil {
+		return nil, err
+	}
+	return createExtendedMessage(extendedHandshakeID, buf.Bytes()), nil
+}
+
+// parseExtendedHandshake decodes the payload of an extended handshake
+func parseExtendedHandshake(payload []byte) (extendedHandshake, error) {
+	hs := extendedHandshake{}
+	err := UnmarshalResponse(bytes.NewReader(payload), &hs)
+	return hs, err
+}
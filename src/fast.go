@@ -0,0 +1,177 @@
+package leecher
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// fastBit is set in reserved byte 7 by peers that speak the fast extension
+// (BEP 6)
+const fastBit = 0x04
+
+const (
+	// allowedFastCount is how many pieces a choked peer may request from
+	// us
+	allowedFastCount = 10
+	// maxSuggestions is how many Suggest Piece hints of a peer we keep
+	maxSuggestions = 16
+)
+
+// SupportsFast reports whether the peer set the fast extension bit
+func (h *HandShake) SupportsFast() bool {
+	return h.Reserved[7]&fastBit != 0
+}
+
+// allowedFastSet computes the pieces a peer at ip may request while it is
+// choked, following the canonical algorithm of BEP 6. Only IPv4 peers get
+// an allowed fast set.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	var set []int
+	seen := make(map[int]bool, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// sendPieces tells the peer which pieces we have. Fast peers get Have All
+// or Have None where possible and their allowed fast set afterwards.
+func (c *Client) sendPieces(bf Bitfield) error {
+	if !c.supportsFast {
+		return c.SendBitfield(bf)
+	}
+	have := 0
+	for index := 0; index < c.numPieces; index++ {
+		if bf.HasPiece(index) {
+			have++
+		}
+	}
+	var msg *Message
+	switch have {
+	case 0:
+		msg = &Message{ID: MsgHaveNone}
+	case c.numPieces:
+		msg = &Message{ID: MsgHaveAll}
+	default:
+		msg = &Message{ID: MsgBitfield, Payload: bf}
+	}
+	if _, err := c.Conn.Write(msg.Serialize()); err != nil {
+		return err
+	}
+
+	c.uploadMu.Lock()
+	c.allowedFastOut = make(map[int]bool)
+	set := allowedFastSet(c.peer.IP, c.infoHash, c.numPieces, allowedFastCount)
+	for _, index := range set {
+		c.allowedFastOut[index] = true
+	}
+	c.uploadMu.Unlock()
+	for _, index := range set {
+		msg := Message{ID: MsgAllowedFast, Payload: pieceIndexPayload(index)}
+		if _, err := c.Conn.Write(msg.Serialize()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleFastMessage handles the messages of the fast extension that may
+// arrive at any time. It reports whether msg was one of them.
+func (c *Client) handleFastMessage(msg *Message) (bool, error) {
+	switch msg.ID {
+	case MsgSuggest, MsgAllowedFast, MsgReject, MsgHaveAll, MsgHaveNone:
+	default:
+		return false, nil
+	}
+	if !c.supportsFast {
+		return true, fmt.Errorf("%s from a peer without the fast extension", msg.messageName())
+	}
+
+	switch msg.ID {
+	case MsgSuggest, MsgAllowedFast:
+		index, err := parsePieceIndex(msg)
+		if err != nil {
+			return true, err
+		}
+		if index >= c.numPieces {
+			return true, fmt.Errorf("%s for piece #%d out of range", msg.messageName(), index)
+		}
+		if msg.ID == MsgAllowedFast {
+			if c.allowedFast == nil {
+				c.allowedFast = make(map[int]bool)
+			}
+			c.allowedFast[index] = true
+		} else if len(c.suggested) < maxSuggestions {
+			c.suggested = append(c.suggested, index)
+		}
+	case MsgReject:
+		// A reject for a request we are not waiting on any more, for
+		// example because the piece was finished by another peer
+		if _, err := parseRequest(msg); err != nil {
+			return true, err
+		}
+	case MsgHaveAll, MsgHaveNone:
+		return true, fmt.Errorf("%s after the first message", msg.messageName())
+	}
+	return true, nil
+}
+
+// canRequest reports whether we may ask the peer for blocks of a piece
+// right now: it has the piece and either unchoked us or allows it fast
+func (c *Client) canRequest(index int) bool {
+	return c.Bitfield.HasPiece(index) && (!c.Choked || c.allowedFast[index])
+}
+
+// SendReject sends a Reject Request message for a request we won't serve
+func (c *Client) SendReject(index, begin, length int) error {
+	msg := createRequestMessage(index, begin, length)
+	msg.ID = MsgReject
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// rejectRequests tells a fast peer that requests we dropped won't be served
+func (c *Client) rejectRequests(reqs []blockRequest) {
+	if !c.supportsFast {
+		return
+	}
+	for _, req := range reqs {
+		c.SendReject(req.index, req.begin, req.length)
+	}
+}
+
+// parsePieceIndex parses the payload of a HAVE, SUGGEST or ALLOWED FAST
+// message
+func parsePieceIndex(msg *Message) (int, error) {
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("expected payload length 4, got length %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+func pieceIndexPayload(index int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return payload
+}
@@ -0,0 +1,29 @@
+package leecher
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// The example of BEP 6
+	var infoHash [20]byte
+	copy(infoHash[:], bytes.Repeat([]byte{0xaa}, 20))
+	ip := net.ParseIP("80.4.4.200")
+
+	tests := []struct {
+		k    int
+		want []int
+	}{
+		{7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+	}
+	for _, test := range tests {
+		got := allowedFastSet(ip, infoHash, 1313, test.k)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("allowedFastSet with k = %d got %v, want %v", test.k, got, test.want)
+		}
+	}
+}
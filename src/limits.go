@@ -0,0 +1,111 @@
+package leecher
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errTooManyConnections = errors.New("connection limit reached")
+
+// connBudget limits the peer connections of the torrents sharing it. A nil
+// budget is unlimited.
+type connBudget struct {
+	mu   sync.Mutex
+	max  int
+	used int
+}
+
+func newConnBudget(max int) *connBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &connBudget{max: max}
+}
+
+// acquire takes a connection from the budget and reports whether one was
+// left
+func (b *connBudget) acquire() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used >= b.max {
+		return false
+	}
+	b.used++
+	return true
+}
+
+// release returns a connection taken with acquire
+func (b *connBudget) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used--
+}
+
+// free is the number of connections left, -1 if there is no limit
+func (b *connBudget) free() int {
+	if b == nil {
+		return -1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.max - b.used
+}
+
+// rateLimiter is a token bucket limiting the bytes per second the
+// torrents sharing it send or receive. It allows bursts of one second. A
+// nil limiter is unlimited.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may pass. It returns false if done was closed
+// first.
+func (l *rateLimiter) wait(n int, done <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	// Take the tokens now, a negative balance makes later callers wait
+	// for us as well
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,158 @@
+package leecher
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// protocolName is the pstr of a BitTorrent handshake
+const protocolName = "BitTorrent protocol"
+
+// Listener accepts connections from peers and hands them to the download
+// of the torrent they ask for
+type Listener struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+}
+
+// Listen accepts peer connections on addr, for example ":6881"
+func Listen(addr string) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		ln:       ln,
+		torrents: make(map[[20]byte]*Torrent),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// Addr is the address the listener accepts connections on
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Add lets peers connect to us for a torrent
+func (l *Listener) Add(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[t.InfoHash] = t
+}
+
+// Remove refuses further connections for a torrent
+func (l *Listener) Remove(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, infoHash)
+}
+
+// Close stops accepting connections. Established connections stay open.
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) torrent(infoHash [20]byte) *Torrent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.torrents[infoHash]
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("Accept failed:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go l.handleConn(conn)
+	}
+}
+
+func (l *Listener) handleConn(conn net.Conn) {
+	client, t, err := acceptClient(conn, l.torrent)
+	if err != nil {
+		log.Printf("Rejected connection from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	log.Printf("Accepted connection from %s\n", client.peer)
+	if !t.AddConn(client) {
+		client.close()
+	}
+}
+
+// acceptClient performs the receiving side of the handshake. The peer
+// speaks first, and we only answer if lookup knows the infohash it asks
+// for.
+func acceptClient(conn net.Conn, lookup func([20]byte) *Torrent) (*Client, *Torrent, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	res, err := handshakeMaker(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.Pstr != protocolName {
+		return nil, nil, fmt.Errorf("unknown protocol %q", res.Pstr)
+	}
+	t := lookup(res.InfoHash)
+	if t == nil {
+		return nil, nil, fmt.Errorf("no active torrent with infohash %x", res.InfoHash)
+	}
+	if res.PeerID == t.PeerID {
+		return nil, nil, errors.New("connected to ourselves")
+	}
+	req := handshakeWithPeer(t.InfoHash, t.PeerID)
+	if _, err := conn.Write(req.Serialize()); err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected address %s", conn.RemoteAddr())
+	}
+	peer := Peer{IP: addr.IP, Port: uint16(addr.Port), ID: res.PeerID}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		peer.IP = ip4
+	}
+
+	client := &Client{
+		Conn:               conn,
+		Choked:             true,
+		peer:               peer,
+		infoHash:           t.InfoHash,
+		peerID:             t.PeerID,
+		remoteID:           res.PeerID,
+		incoming:           true,
+		numPieces:          len(t.PieceHashes),
+		supportsFast:       res.SupportsFast(),
+		supportsExtensions: res.SupportsExtensions(),
+		extensions:         t.Extensions,
+	}
+	if err := client.sendExtendedHandshake(); err != nil {
+		client.close()
+		return nil, nil, err
+	}
+	if err := client.sendPieces(t.bitfield()); err != nil {
+		client.close()
+		return nil, nil, err
+	}
+	bf, err := client.recvBitfield()
+	if err != nil {
+		client.close()
+		return nil, nil, err
+	}
+	client.Bitfield = bf
+	return client, t, nil
+}
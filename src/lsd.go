@@ -0,0 +1,243 @@
+package leecher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LSDAddr is the multicast group of Local Service Discovery (BEP 14)
+const LSDAddr = "239.192.152.143:6771"
+
+const (
+	// lsdInterval is how often every torrent is announced on the LAN
+	lsdInterval = 5 * time.Minute
+	// lsdMaxMessageSize is more than any sane BT-SEARCH message needs
+	lsdMaxMessageSize = 1400
+)
+
+// LSD finds peers on the local network by announcing our torrents to a
+// multicast group and listening to the announcements of other clients
+type LSD struct {
+	conn   *net.UDPConn
+	send   *net.UDPConn
+	group  *net.UDPAddr
+	port   uint16
+	cookie string
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLSD joins the LSD multicast group. port is the port peers should
+// connect to.
+func NewLSD(port uint16) (*LSD, error) {
+	return ListenLSD(LSDAddr, nil, port)
+}
+
+// ListenLSD joins the multicast group on the interface ifi, or the
+// system's default multicast interface if ifi is nil. Passing the loopback
+// interface keeps LSD on this host, which is handy for tests.
+func ListenLSD(group string, ifi *net.Interface, port uint16) (*LSD, error) {
+	groupAddr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	if !groupAddr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", group)
+	}
+	network := "udp4"
+	if groupAddr.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	conn, err := net.ListenMulticastUDP(network, ifi, groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	// Without an interface, announcements go out on a socket of their own.
+	// Unlike the listening socket it loops multicast back, so clients on
+	// the same host see us. The listening socket is bound to ifi, so it
+	// sends on ifi when one was given.
+	send := conn
+	if ifi == nil {
+		send, err = net.ListenUDP(network, nil)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	cookie, err := randomUint32()
+	if err != nil {
+		conn.Close()
+		if send != conn {
+			send.Close()
+		}
+		return nil, err
+	}
+
+	l := &LSD{
+		conn:     conn,
+		send:     send,
+		group:    groupAddr,
+		port:     port,
+		cookie:   strconv.FormatUint(uint64(cookie), 16),
+		torrents: make(map[[20]byte]*Torrent),
+		done:     make(chan struct{}),
+	}
+	go l.readLoop()
+	go l.run()
+	return l, nil
+}
+
+// Add announces a torrent on the LAN and hands the local peers found for
+// it to its download
+func (l *LSD) Add(t *Torrent) {
+	l.mu.Lock()
+	l.torrents[t.InfoHash] = t
+	l.mu.Unlock()
+	if err := l.announce(t.InfoHash); err != nil {
+		log.Println("LSD announce failed:", err)
+	}
+}
+
+// Remove stops announcing a torrent
+func (l *LSD) Remove(infoHash [20]byte) {
+	l.mu.Lock()
+	delete(l.torrents, infoHash)
+	l.mu.Unlock()
+}
+
+// Close leaves the multicast group
+func (l *LSD) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.conn.Close()
+		if l.send != l.conn {
+			l.send.Close()
+		}
+	})
+	return err
+}
+
+func (l *LSD) run() {
+	ticker := time.NewTicker(lsdInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		infoHashes := make([][20]byte, 0, len(l.torrents))
+		for infoHash := range l.torrents {
+			infoHashes = append(infoHashes, infoHash)
+		}
+		l.mu.Unlock()
+		for _, infoHash := range infoHashes {
+			if err := l.announce(infoHash); err != nil {
+				log.Println("LSD announce failed:", err)
+			}
+		}
+	}
+}
+
+// announce sends a BT-SEARCH message for one torrent. Older clients only
+// read the first Infohash header, so every torrent gets its own message.
+func (l *LSD) announce(infoHash [20]byte) error {
+	msg := createLSDMessage(l.group.String(), l.port, l.cookie, infoHash)
+	_, err := l.send.WriteToUDP(msg, l.group)
+	return err
+}
+
+func (l *LSD) readLoop() {
+	buf := make([]byte, lsdMaxMessageSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			log.Println("LSD read failed:", err)
+			return
+		}
+
+		port, cookie, infoHashes, err := parseLSDMessage(buf[:n])
+		if err != nil || cookie == l.cookie {
+			continue // garbage or our own announcement
+		}
+		peer := Peer{IP: addr.IP, Port: port}
+		for _, infoHash := range infoHashes {
+			l.mu.Lock()
+			t := l.torrents[infoHash]
+			l.mu.Unlock()
+			if t != nil {
+				log.Printf("Found local peer %s\n", peer)
+				t.AddPeers([]Peer{peer})
+			}
+		}
+	}
+}
+
+// createLSDMessage builds a BT-SEARCH message
+func createLSDMessage(host string, port uint16, cookie string, infoHash [20]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", host)
+	fmt.Fprintf(&buf, "Port: %d\r\n", port)
+	fmt.Fprintf(&buf, "Infohash: %s\r\n", hex.EncodeToString(infoHash[:]))
+	fmt.Fprintf(&buf, "cookie: %s\r\n", cookie)
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// parseLSDMessage reads the port, cookie and infohashes of a BT-SEARCH
+// message. Infohashes that are not 40 hex digits are skipped.
+func parseLSDMessage(msg []byte) (uint16, string, [][20]byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if req.Method != "BT-SEARCH" {
+		return 0, "", nil, fmt.Errorf("unexpected LSD method %q", req.Method)
+	}
+	port, err := strconv.ParseUint(strings.TrimSpace(req.Header.Get("Port")), 10, 16)
+	if err != nil || port == 0 {
+		return 0, "", nil, fmt.Errorf("invalid LSD port %q", req.Header.Get("Port"))
+	}
+
+	var infoHashes [][20]byte
+	for _, value := range req.Header.Values("Infohash") {
+		raw, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(raw) != 20 {
+			continue
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], raw)
+		infoHashes = append(infoHashes, infoHash)
+	}
+	if len(infoHashes) == 0 {
+		return 0, "", nil, errors.New("LSD message without an infohash")
+	}
+	return uint16(port), strings.TrimSpace(req.Header.Get("cookie")), infoHashes, nil
+}
@@ -0,0 +1,70 @@
+package leecher
+
+import (
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+)
+
+// loopbackInterface returns the loopback interface
+func loopbackInterface(t *testing.T) *net.Interface {
+	t.Helper()
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ifis {
+		if ifis[i].Flags&net.FlagLoopback != 0 {
+			return &ifis[i]
+		}
+	}
+	t.Skip("no loopback interface")
+	return nil
+}
+
+// waitForPeer waits until the LSD hands a peer on port to t
+func waitForPeer(t *testing.T, torrent *Torrent, port uint16) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-torrent.peerSignal():
+			for _, peer := range torrent.takePendingPeers() {
+				if peer.Port == port {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatalf("no local peer on port %d was found", port)
+		}
+	}
+}
+
+func TestLSDPeersFindEachOther(t *testing.T) {
+	lo := loopbackInterface(t)
+	a, err := ListenLSD(LSDAddr, lo, 1111)
+	if err != nil {
+		t.Skip("can't join the LSD group on loopback:", err)
+	}
+	defer a.Close()
+	b, err := ListenLSD(LSDAddr, lo, 2222)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	infoHash := sha1.Sum([]byte("lsd test"))
+	ta := &Torrent{InfoHash: infoHash}
+	tb := &Torrent{InfoHash: infoHash}
+	b.Add(tb)
+	a.Add(ta) // announces ta, which b is listening for
+	waitForPeer(t, tb, 1111)
+
+	// a only listens for the torrent since its Add, so b has to announce
+	// again for a to see it
+	if err := b.announce(infoHash); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeer(t, ta, 2222)
+}
@@ -0,0 +1,171 @@
+package leecher
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet holds the parts of a magnet URI we know how to use
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	WebSeeds []string
+	Peers    []Peer
+}
+
+// ParseMagnet parses a magnet:?xt=urn:btih:... URI
+func ParseMagnet(uri string) (Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Magnet{}, fmt.Errorf("failed to parse magnet URI: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("expected magnet URI but got scheme %q", u.Scheme)
+	}
+	q := u.Query()
+
+	m := Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		WebSeeds: q["ws"],
+	}
+
+	found := false
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		m.InfoHash, err = parseInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		if err != nil {
+			return Magnet{}, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return Magnet{}, fmt.Errorf("magnet URI has no urn:btih exact topic")
+	}
+
+	for _, pe := range q["x.pe"] {
+		peer, err := parsePeerAddr(pe)
+		if err != nil {
+			continue // unresolvable peers are not fatal
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+	return m, nil
+}
+
+// parseInfoHash accepts the hex and base32 encodings of an infohash
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	var buf []byte
+	var err error
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return infoHash, fmt.Errorf("infohash %q has invalid length %d", s, len(s))
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("malformed infohash %q: %w", s, err)
+	}
+	copy(infoHash[:], buf)
+	return infoHash, nil
+}
+
+// parsePeerAddr turns a host:port string into a Peer
+func parsePeerAddr(addr string) (Peer, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Peer{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Peer{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return Peer{}, fmt.Errorf("could not resolve %s", host)
+		}
+		ip = ips[0]
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return Peer{IP: ip, Port: uint16(port)}, nil
+}
+
+// trackerTiers puts every tracker of the magnet URI into its own tier,
+// the torrent announces to them in order
+func (m Magnet) trackerTiers() [][]string {
+	tiers := make([][]string, len(m.Trackers))
+	for i, tr := range m.Trackers {
+		tiers[i] = []string{tr}
+	}
+	return tiers
+}
+
+// OpenMagnet finds peers for a magnet URI and fetches the info dictionary
+// from them (BEP 9)
+func OpenMagnet(uri string) (TorrentFile, error) {
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	peerID, err := generatePeerID()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	// Unlike announces, which stop at the first tracker that answers, every
+	// tracker is asked: the more peers we know, the likelier one of them
+	// has the metadata
+	peers := m.Peers
+	for _, tracker := range m.Trackers {
+		tf := TorrentFile{Announce: tracker, InfoHash: m.InfoHash}
+		found, err := tf.requestPeers(peerID, DefaultPort)
+		if err != nil {
+			continue // announce logged why
+		}
+		peers = dedupePeers(append(peers, found...))
+	}
+
+	metadata, err := fetchMetadata(peers, peerID, m.InfoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return m.torrentFile(metadata)
+}
+
+// torrentFile builds a TorrentFile from verified metadata
+func (m Magnet) torrentFile(metadata []byte) (TorrentFile, error) {
+	bt := bencodeTorrent{}
+	if len(m.Trackers) > 0 {
+		bt.Announce = m.Trackers[0]
+		bt.AnnounceList = m.trackerTiers()
+	}
+	err := UnmarshalResponse(bytes.NewReader(metadata), &bt.Info)
+	if err != nil {
+		return TorrentFile{}, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	tf, err := bt.toTorrentFile()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	// The metadata has been checked against the real infohash, which can
+	// differ from the re-encoded one if the dictionary has unknown keys
+	tf.InfoHash = m.InfoHash
+	return tf, nil
+}
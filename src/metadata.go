@@ -0,0 +1,276 @@
+package leecher
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// metadataPieceSize is the block size of the info dictionary (BEP 9)
+	metadataPieceSize = 16384
+	// maxMetadataSize guards against peers announcing absurd sizes
+	maxMetadataSize = 16 * 1024 * 1024
+	// maxMetadataPeers is how many peers we ask for metadata at once
+	maxMetadataPeers = 8
+)
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+type bencodeMetadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// createMetadataRequest creates the payload of a ut_metadata request for
+// one piece
+func createMetadataRequest(piece int) ([]byte, error) {
+	var buf bytes.Buffer
+	err := DescodeMarshal(&buf, bencodeMetadataMessage{MsgType: metadataRequest, Piece: piece})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseMetadataMessage decodes a ut_metadata message. Data messages carry
+// the piece right after the bencoded dictionary.
+func parseMetadataMessage(payload []byte) (bencodeMetadataMessage, []byte, error) {
+	msg := bencodeMetadataMessage{}
+	rd := bytes.NewReader(payload)
+	br := bufio.NewReader(rd)
+	if err := UnmarshalResponse(br, &msg); err != nil {
+		return msg, nil, err
+	}
+	consumed := len(payload) - br.Buffered() - rd.Len()
+	return msg, payload[consumed:], nil
+}
+
+// metadataFetch implements the requesting side of ut_metadata (BEP 9) for
+// a single connection. It asks for every piece of the info dictionary once
+// the peer's extended handshake arrives and verifies the result against
+// the infohash.
+type metadataFetch struct {
+	infoHash [20]byte
+
+	mu        sync.Mutex
+	metadata  []byte
+	numPieces int
+	received  map[int]bool
+	err       error
+	done      chan struct{}
+}
+
+func newMetadataFetch(infoHash [20]byte) *metadataFetch {
+	return &metadataFetch{
+		infoHash: infoHash,
+		received: make(map[int]bool),
+		done:     make(chan struct{}),
+	}
+}
+
+func (f *metadataFetch) Name() string {
+	return "ut_metadata"
+}
+
+// HandleHandshake requests every metadata piece. A repeated extended
+// handshake does not request them again.
+func (f *metadataFetch) HandleHandshake(c *Client) error {
+	if !c.SupportsExtension(f.Name()) {
+		return errors.New("peer does not support ut_metadata")
+	}
+	size := c.metadataSize()
+	if size <= 0 || size > maxMetadataSize {
+		return fmt.Errorf("invalid metadata size %d", size)
+	}
+	f.mu.Lock()
+	if f.metadata != nil {
+		f.mu.Unlock()
+		return nil
+	}
+	f.metadata = make([]byte, size)
+	f.numPieces = (size + metadataPieceSize - 1) / metadataPieceSize
+	numPieces := f.numPieces
+	f.mu.Unlock()
+
+	for piece := 0; piece < numPieces; piece++ {
+		req, err := createMetadataRequest(piece)
+		if err != nil {
+			return err
+		}
+		if err := c.SendExtended(f.Name(), req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *metadataFetch) HandleMessage(c *Client, payload []byte) error {
+	mm, data, err := parseMetadataMessage(payload)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.metadata == nil {
+		return nil // nothing requested yet
+	}
+	switch mm.MsgType {
+	case metadataReject:
+		return fmt.Errorf("peer rejected metadata piece %d", mm.Piece)
+	case metadataData:
+		begin := mm.Piece * metadataPieceSize
+		if mm.Piece < 0 || mm.Piece >= f.numPieces || begin+len(data) > len(f.metadata) {
+			return fmt.Errorf("metadata piece %d out of range", mm.Piece)
+		}
+		copy(f.metadata[begin:], data)
+		f.received[mm.Piece] = true
+		if len(f.received) == f.numPieces {
+			f.finish()
+		}
+	}
+	return nil
+}
+
+// finish verifies the complete metadata and wakes up the fetcher. f.mu is
+// held by the caller.
+func (f *metadataFetch) finish() {
+	select {
+	case <-f.done:
+		return
+	default:
+	}
+	hash := sha1.Sum(f.metadata)
+	if !bytes.Equal(hash[:], f.infoHash[:]) {
+		f.err = fmt.Errorf("metadata hash %x does not match infohash %x", hash, f.infoHash)
+	}
+	close(f.done)
+}
+
+// result returns the verified metadata once the fetch is done
+func (f *metadataFetch) result() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.metadata, nil
+}
+
+// fetchMetadata downloads the info dictionary of infoHash from the first
+// peer that can provide it. Peers not dialed yet are skipped and the other
+// connections closed once one of them succeeded.
+func fetchMetadata(peers []Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers to fetch metadata from")
+	}
+	results := make(chan []byte, len(peers))
+	slots := make(chan struct{}, maxMetadataPeers)
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, peer := range peers {
+		go func(peer Peer) {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				results <- nil
+				return
+			}
+			defer func() { <-slots }()
+			metadata, err := fetchMetadataFromPeer(peer, peerID, infoHash, stop)
+			if err != nil {
+				log.Printf("Could not fetch metadata from %s: %v\n", peer, err)
+			}
+			results <- metadata
+		}(peer)
+	}
+
+	for range peers {
+		if metadata := <-results; metadata != nil {
+			return metadata, nil
+		}
+	}
+	return nil, fmt.Errorf("none of %d peers provided metadata for %x", len(peers), infoHash)
+}
+
+// fetchMetadataFromPeer runs the ut_metadata exchange with a single peer.
+// It gives up when stop is closed.
+func fetchMetadataFromPeer(peer Peer, peerID, infoHash [20]byte, stop <-chan struct{}) ([]byte, error) {
+	select {
+	case <-stop:
+		return nil, errors.New("metadata already fetched")
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	res, err := completeHandShake(conn, infoHash, peerID)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !res.SupportsExtensions() {
+		conn.Close()
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+
+	fetch := newMetadataFetch(infoHash)
+	extensions := NewExtensionRegistry()
+	if err := extensions.Register(fetch); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := &Client{
+		Conn:               conn,
+		Choked:             true,
+		peer:               peer,
+		infoHash:           infoHash,
+		peerID:             peerID,
+		remoteID:           res.PeerID,
+		supportsExtensions: true,
+		extensions:         extensions,
+	}
+	defer client.close()
+	go func() {
+		select {
+		case <-stop:
+			client.close()
+		case <-client.closedSignal():
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := client.sendExtendedHandshake(); err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case <-fetch.done:
+			return fetch.result()
+		default:
+		}
+		msg, err := client.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != MsgExtended {
+			continue // keep-alive or a message we don't need here
+		}
+		if err := client.handleExtended(msg); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package leecher
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMinPeers is how many connections a download tries to keep
+	DefaultMinPeers = 8
+	// DefaultStallTimeout is how long a download may go without receiving
+	// any data before it gives up
+	DefaultStallTimeout = 5 * time.Minute
+	// peerManagerInterval is how often the peer manager checks the swarm
+	peerManagerInterval = 5 * time.Second
+	// redialBackoff is the wait before re-dialing a peer after its first
+	// failure. It doubles with every further failure up to maxRedialBackoff.
+	redialBackoff    = 15 * time.Second
+	maxRedialBackoff = 5 * time.Minute
+	// maxStallReasons is how many peer failures a StalledError lists
+	maxStallReasons = 10
+)
+
+var errAlreadyConnected = errors.New("already connected on another address")
+
+// StalledError is returned by Download when no peer sent us any data for
+// StallTimeout. Failures holds the reason each peer we tried last failed
+// with.
+type StalledError struct {
+	Name     string
+	Timeout  time.Duration
+	Left     int64
+	Failures map[string]error
+}
+
+func (e *StalledError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "download of %s stalled: no data for %s with %d bytes left", e.Name, e.Timeout, e.Left)
+	if len(e.Failures) == 0 {
+		b.WriteString(", no peers were found")
+		return b.String()
+	}
+	peers := make([]string, 0, len(e.Failures))
+	for peer := range e.Failures {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	fmt.Fprintf(&b, ", %d peers failed:", len(peers))
+	for i, peer := range peers {
+		if i == maxStallReasons {
+			fmt.Fprintf(&b, " and %d more", len(peers)-i)
+			break
+		}
+		if i > 0 {
+			b.WriteString(";")
+		}
+		fmt.Fprintf(&b, " %s: %v", peer, e.Failures[peer])
+	}
+	return b.String()
+}
+
+// peerState is what the peer manager knows about one peer
+type peerState struct {
+	peer Peer
+	// incoming is set for peers that connected to us, we can't dial them
+	incoming  bool
+	active    bool
+	failures  int
+	nextDial  time.Time
+	lastError error
+}
+
+// peerExit reports why the connection to a peer ended
+type peerExit struct {
+	addr string
+	err  error
+}
+
+// peerManager keeps a download connected to the swarm. It dials every new
+// peer, re-dials failed peers with a backoff while there are fewer than
+// MinPeers connections, asks the trackers for more peers when it runs out
+// and gives up when no data arrived for StallTimeout.
+type peerManager struct {
+	torrent *Torrent
+	picker  *piecePicker
+	results chan *pieceResult
+	exits   chan peerExit
+	peers   map[string]*peerState
+	// keys holds the keys of every peer we know, so a peer known by its
+	// ID is not dialed again on another address
+	keys map[string]bool
+	// last holds the byte counter of each connection at the previous check
+	last         map[*Client]int64
+	lastProgress time.Time
+}
+
+func newPeerManager(t *Torrent, picker *piecePicker, results chan *pieceResult) *peerManager {
+	return &peerManager{
+		torrent:      t,
+		picker:       picker,
+		results:      results,
+		exits:        make(chan peerExit),
+		peers:        make(map[string]*peerState),
+		keys:         make(map[string]bool),
+		last:         make(map[*Client]int64),
+		lastProgress: time.Now(),
+	}
+}
+
+func (t *Torrent) minPeers() int {
+	if t.MinPeers > 0 {
+		return t.MinPeers
+	}
+	return DefaultMinPeers
+}
+
+func (t *Torrent) stallTimeout() time.Duration {
+	if t.StallTimeout > 0 {
+		return t.StallTimeout
+	}
+	return DefaultStallTimeout
+}
+
+// add dials the peers we didn't know yet
+func (m *peerManager) add(peers []Peer) {
+	for _, peer := range peers {
+		if m.keys[peer.key()] || m.peers[peer.String()] != nil {
+			continue
+		}
+		m.keys[peer.key()] = true
+		state := &peerState{peer: peer}
+		m.peers[peer.String()] = state
+		m.dial(state)
+	}
+}
+
+// accept downloads over a connection a peer opened to us
+func (m *peerManager) accept(c *Client) {
+	addr := c.peer.String()
+	m.peers[addr] = &peerState{peer: c.peer, incoming: true, active: true}
+	m.torrent.goWorker(func() {
+		m.report(addr, m.torrent.downloadFromClient(c, m.picker, m.results))
+	})
+}
+
+func (m *peerManager) dial(state *peerState) {
+	state.active = true
+	addr := state.peer.String()
+	m.torrent.goWorker(func() {
+		m.report(addr, m.torrent.downloadFromPeer(state.peer, m.picker, m.results))
+	})
+}
+
+// report hands the end of a connection to the manager, unless the
+// download is over
+func (m *peerManager) report(addr string, err error) {
+	select {
+	case m.exits <- peerExit{addr, err}:
+	case <-m.torrent.doneSignal():
+	}
+}
+
+// exited records how the connection to a peer ended
+func (m *peerManager) exited(exit peerExit) {
+	state := m.peers[exit.addr]
+	if state == nil {
+		return
+	}
+	state.active = false
+	if exit.err == nil {
+		return
+	}
+	state.failures++
+	state.lastError = exit.err
+	backoff := redialBackoff << (state.failures - 1)
+	if backoff > maxRedialBackoff || backoff <= 0 {
+		backoff = maxRedialBackoff
+	}
+	state.nextDial = time.Now().Add(backoff)
+}
+
+// maintain re-dials peers and asks for more when the download runs low
+// on connections. It returns a StalledError if no data arrived for the
+// stall timeout.
+func (m *peerManager) maintain() error {
+	t := m.torrent
+	m.redial()
+	if m.progressed(t.connectedClients()) {
+		m.lastProgress = time.Now()
+	} else if stalled := time.Since(m.lastProgress); stalled >= t.stallTimeout() {
+		return m.stalledError(stalled)
+	}
+	return nil
+}
+
+// redial dials peers whose backoff is over while there are fewer than
+// MinPeers connections and asks the trackers for more if that's not
+// enough
+func (m *peerManager) redial() {
+	active := 0
+	for _, state := range m.peers {
+		if state.active {
+			active++
+		}
+	}
+	missing := m.torrent.minPeers() - active
+	if free := m.torrent.conns.free(); free >= 0 && free < missing {
+		missing = free // the other torrents of the session use the rest
+	}
+	if missing <= 0 {
+		return
+	}
+	now := time.Now()
+	var ready []*peerState
+	for _, state := range m.peers {
+		if !state.active && !state.incoming && !now.Before(state.nextDial) {
+			ready = append(ready, state)
+		}
+	}
+	// Peers that failed least often are tried first
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].failures < ready[j].failures
+	})
+	for i := 0; i < missing && i < len(ready); i++ {
+		log.Printf("Re-dialing %s after %d failures\n", ready[i].peer, ready[i].failures)
+		m.dial(ready[i])
+	}
+	if len(ready) < missing {
+		m.torrent.requestPeers()
+	}
+}
+
+// progressed reports whether any connection received data since the last
+// check
+func (m *peerManager) progressed(clients []*Client) bool {
+	progressed := false
+	counts := make(map[*Client]int64, len(clients))
+	for _, c := range clients {
+		counts[c] = c.downloadedBytes.Load()
+		if counts[c] > m.last[c] {
+			progressed = true
+		}
+	}
+	m.last = counts
+	return progressed
+}
+
+func (m *peerManager) stalledError(stalled time.Duration) error {
+	failures := make(map[string]error)
+	for addr, state := range m.peers {
+		if state.lastError != nil {
+			failures[addr] = state.lastError
+		}
+	}
+	return &StalledError{
+		Name:     m.torrent.Name,
+		Timeout:  stalled.Round(time.Second),
+		Left:     m.torrent.bytesLeft(),
+		Failures: failures,
+	}
+}
+
+// requestPeers asks the trackers for more peers. The announcer decides
+// when the trackers allow another announce.
+func (t *Torrent) requestPeers() {
+	select {
+	case t.wantPeersSignal() <- struct{}{}:
+	default: // a request is already pending
+	}
+}
+
+func (t *Torrent) wantPeersSignal() chan struct{} {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	if t.wantPeers == nil {
+		t.wantPeers = make(chan struct{}, 1)
+	}
+	return t.wantPeers
+}
@@ -2,11 +2,11 @@ package leecher
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
 	"log"
-	"runtime"
 	"time"
 )
 
@@ -29,121 +29,267 @@ type pieceResult struct {
 }
 
 type pieceProgress struct {
-	index      int
-	client     *Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+	client   *Client
+	picker   *piecePicker
+	download *pieceDownload
+	// completed is set when a block of this peer completed the piece
+	completed bool
 }
 
-func (t *Torrent) downloadFromPeer(peer Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	client, err := CliantConnector(peer, t.PeerID, t.InfoHash)
+const (
+	// idleWait is how long a worker whose peer has nothing for us waits
+	// for a message before it asks the picker again
+	idleWait = time.Second
+	// blockWait is how often a worker checks whether other workers
+	// finished the piece it is downloading
+	blockWait = 250 * time.Millisecond
+)
+
+// downloadFromPeer connects to a peer and downloads from it. It returns
+// why the connection ended, nil if the download is done.
+func (t *Torrent) downloadFromPeer(peer Peer, picker *piecePicker, results chan *pieceResult) error {
+	client, err := CliantConnector(peer, t.PeerID, t.InfoHash, t.Extensions, t.bitfield(), len(t.PieceHashes))
 	if err != nil {
 		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
-		return
+		return err
 	}
-	defer client.Conn.Close()
 	log.Printf("Completed handshake with %s\n", peer.IP)
-	client.SendUnchoke()
-	client.SendInterested()
+	return t.downloadFromClient(client, picker, results)
+}
 
-	for pw := range workQueue {
-		if !client.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw // Put piece back on the queue
+// downloadFromClient downloads the pieces the picker hands out over an
+// established connection, whichever side opened it. Once the download is
+// done the connection is kept for seeding until the torrent is finished.
+// It returns why the connection ended before, or nil.
+func (t *Torrent) downloadFromClient(client *Client, picker *piecePicker, results chan *pieceResult) error {
+	defer client.close()
+	if err := t.claimPeer(client); err != nil {
+		log.Printf("Dropping %s: %v\n", client.peer, err)
+		return err
+	}
+	defer t.releasePeer(client)
+	defer t.closeOnFinish(client)()
+	stopUploads := make(chan struct{})
+	defer close(stopUploads)
+	t.goWorker(func() { t.uploadLoop(client, stopUploads) })
+
+	picker.addBitfield(client.Bitfield)
+	defer func() { picker.removeBitfield(client.Bitfield) }()
+
+	interested := false
+	for !picker.finished() {
+		if wanted := picker.interesting(client.Bitfield); wanted != interested {
+			if wanted {
+				client.SendInterested()
+			} else {
+				client.SendNotInterested()
+			}
+			interested = wanted
+		}
+		pd := picker.pick(client)
+		if pd == nil {
+			// The peer chokes us or has nothing for us right now. Handle
+			// its messages until that changes or another worker hands a
+			// piece back.
+			if err := client.idle(picker); err != nil {
+				log.Println("Exiting", err)
+				return err
+			}
 			continue
 		}
 
 		// Download the piece
-		buf, err := attemptDownloadPiece(client, pw)
+		buf, err := attemptDownloadPiece(client, pd, picker)
+		picker.release(pd, client)
 		if err != nil {
 			log.Println("Exiting", err)
-			workQueue <- pw // Put piece back on the queue
-			return
+			return err
+		}
+		if buf == nil {
+			continue // another worker completed the piece or we got choked
 		}
 
-		if err = checkIntegrity(pw, buf); err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw // Put piece back on the queue
+		if err = checkIntegrity(&pd.work, buf); err != nil {
+			log.Printf("Piece #%d failed integrity check\n", pd.work.index)
+			picker.reset(pd)
 			continue
 		}
 
-		client.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+		select {
+		case results <- &pieceResult{pd.work.index, buf}:
+		case <-t.doneSignal():
+			return nil // Download gave up
+		}
 	}
+	t.serveClient(client)
+	return nil
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read() // this call blocks
+// idle handles at most one message of a peer we are not downloading from,
+// waiting up to idleWait for it
+func (c *Client) idle(picker *piecePicker) error {
+	ready, err := c.waitMessage(idleWait)
+	if err != nil || !ready {
+		return err
+	}
+	msg, err := c.Read()
 	if err != nil {
 		return err
 	}
+	return c.handleMessage(msg, picker)
+}
 
+// handleMessage handles every message but PIECE. picker may be nil once
+// there is nothing left to download.
+func (c *Client) handleMessage(msg *Message, picker *piecePicker) error {
 	if msg == nil { // keep-alive
 		return nil
 	}
+	if handled, err := c.handleUploadMessage(msg); handled {
+		return err
+	}
+	if handled, err := c.handleFastMessage(msg); handled {
+		return err
+	}
 
 	switch msg.ID {
 	case MsgUnchoke:
-		state.client.Choked = false
+		c.Choked = false
 	case MsgChoke:
-		state.client.Choked = true
+		c.Choked = true
 	case MsgHave:
 		index, err := MParseHave(msg)
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.SetPiece(index)
-	case MsgPiece:
-		n, err := MParsePiece(state.index, state.buf, msg)
+		if index >= c.numPieces {
+			return &ProtocolError{Peer: c.peer.String(), Reason: fmt.Sprintf("have for piece #%d out of range", index)}
+		}
+		if !c.Bitfield.HasPiece(index) {
+			c.Bitfield.SetPiece(index)
+			if picker != nil {
+				picker.addHave(index)
+			}
+		}
+	case MsgExtended:
+		return c.handleExtended(msg)
+	}
+	return nil
+}
+
+func (state *pieceProgress) readMessage() error {
+	msg, err := state.client.Read() // this call blocks
+	if err != nil {
+		return err
+	}
+
+	if msg != nil && msg.ID == MsgReject && state.client.supportsFast {
+		req, err := parseRequest(msg)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
+		if req.index != state.download.work.index {
+			return nil
+		}
+		if state.client.canRequest(req.index) {
+			state.download.blockRejected(state.client, req.begin)
+		} else {
+			// Fast peers reject our requests when they choke us
+			state.download.forgetBlock(state.client, req.begin)
+		}
+		return nil
+	}
+	if msg == nil || msg.ID != MsgPiece {
+		if err := state.client.handleMessage(msg, state.picker); err != nil {
+			return err
+		}
+		if state.client.Choked && !state.client.supportsFast {
+			// A peer that chokes us drops our requests, a fast peer
+			// rejects them one by one
+			state.download.forgetRequests(state.client)
+		}
+		return nil
+	}
+	if len(msg.Payload) < 8 {
+		return fmt.Errorf("payload too short. %d < 8", len(msg.Payload))
+	}
+	state.client.downloadedBytes.Add(int64(len(msg.Payload) - 8))
+	if !state.client.downloadLimit.wait(len(msg.Payload)-8, state.client.finished) {
+		return errTorrentFinished
+	}
+	pw := state.download.work
+	if int(binary.BigEndian.Uint32(msg.Payload[0:4])) != pw.index {
+		return nil // a block of a piece we are done with, sent before our cancel
+	}
+	others, completed, err := state.download.blockReceived(state.client, msg)
+	if err != nil {
+		return err
+	}
+	state.completed = state.completed || completed
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	for _, other := range others {
+		other.SendCancel(pw.index, begin, len(msg.Payload)-8)
 	}
-
 	return nil
 }
 
-func attemptDownloadPiece(c *Client, pw *pieceWork) ([]byte, error) {
+// attemptDownloadPiece downloads the blocks of pd that c is asked for. It
+// returns the piece if a block of c completed it and nil if another
+// worker did.
+func attemptDownloadPiece(c *Client, pd *pieceDownload, picker *piecePicker) ([]byte, error) {
 	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+		client:   c,
+		picker:   picker,
+		download: pd,
 	}
 
 	// Setting a deadline helps get unresponsive peers unstuck.
 	// 30 seconds is more than enough time to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	deadline := time.Now().Add(30 * time.Second)
+	c.Conn.SetWriteDeadline(deadline)
 	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
 
-	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.backlog < maxBacklog && state.requested < pw.length {
-				blockSize := maxBlockSize
-				// Last block might be shorter than the typical block
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
+	for !pd.complete() {
+		// If we may, send requests until we have enough unfulfilled requests
+		if c.canRequest(pd.work.index) {
+			for pd.outstanding(c) < maxBacklog {
+				begin, length, ok := pd.nextBlock(c)
+				if !ok {
+					break
 				}
-
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
+				if err := c.SendRequest(pd.work.index, begin, length); err != nil {
 					return nil, err
 				}
-				state.backlog++
-				state.requested += blockSize
 			}
+		} else if pd.outstanding(c) == 0 {
+			return nil, nil // choked, the piece goes back to the picker
+		}
+		if pd.outstanding(c) == 0 && pd.rejectedAll(c) {
+			return nil, nil // the peer won't send what is left
 		}
 
-		err := state.readMessage()
+		// Wait briefly so a piece other workers complete in endgame is
+		// noticed
+		ready, err := c.waitMessage(blockWait)
 		if err != nil {
 			return nil, err
 		}
+		if !ready {
+			if time.Now().After(deadline) {
+				return nil, fmt.Errorf("timed out downloading piece #%d from %s", pd.work.index, c.peer)
+			}
+			continue
+		}
+		c.Conn.SetReadDeadline(deadline)
+		if err := state.readMessage(); err != nil {
+			return nil, err
+		}
 	}
 
-	return state.buf, nil
+	if !state.completed {
+		return nil, nil
+	}
+	return pd.buf, nil
 }
 
 func checkIntegrity(pw *pieceWork, buf []byte) error {
@@ -188,39 +334,252 @@ func (bf Bitfield) SetPiece(index int) {
 	bf[byteIndex] |= 1 << (7 - bitOffset)
 }
 
-func (t *Torrent) Download() ([]byte, error) {
+// Download fetches every piece from the peers and writes each one to
+// storage as soon as it has been verified. It returns once all pieces
+// have been flushed. The connections stay open so Seed can upload on
+// them; they are closed when Seed returns. If ctx is cancelled or the
+// download fails, the torrent is finished right away: every connection
+// is closed and the pieces downloaded so far are flushed.
+func (t *Torrent) Download(ctx context.Context) (err error) {
 	log.Println("Starting download for", t.Name)
-	// Init queues for workers to retrieve work and send results
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
+	picker := newPiecePicker(t)
 	results := make(chan *pieceResult)
 
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+	donePieces := picker.done
+	if donePieces == len(t.PieceHashes) {
+		log.Println("All pieces already downloaded")
+		return nil
 	}
 
-	// Start worker
-	for _, peer := range t.Peers {
-		go t.downloadFromPeer(peer, workQueue, results)
-	}
+	// Start a worker for every peer we know of and for the ones found
+	// while the download is running
+	peers := newPeerManager(t, picker, results)
+	peers.add(t.Peers)
+	ticker := time.NewTicker(peerManagerInterval)
+	defer ticker.Stop()
+	t.setAccepting(true)
+	defer t.setAccepting(false)
+	stopChoker := make(chan struct{})
+	defer close(stopChoker)
+	go t.runChoker(stopChoker)
+	defer func() {
+		if err != nil {
+			t.finishAndWait()
+			if flushErr := t.Storage.Flush(); flushErr != nil {
+				log.Println("Could not flush storage:", flushErr)
+			}
+		}
+	}()
 
-	// Collect results into a buffer until full
-	buf := make([]byte, t.Length)
-	donePieces := 0
+	// Write results to storage until every piece is done
 	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
+		var res *pieceResult
+		select {
+		case <-ctx.Done():
+			log.Println("Stopped download of", t.Name)
+			return ctx.Err()
+		case <-t.peerSignal():
+			peers.add(t.takePendingPeers())
+			for _, c := range t.takePendingConns() {
+				peers.accept(c)
+			}
+			continue
+		case exit := <-peers.exits:
+			peers.exited(exit)
+			continue
+		case <-ticker.C:
+			if err := peers.maintain(); err != nil {
+				log.Println(err)
+				return err
+			}
+			continue
+		case res = <-results:
+		}
+		piece := t.Storage.Piece(res.index)
+		if _, err := piece.WriteAt(res.buf, 0); err != nil {
+			return fmt.Errorf("failed to write piece #%d: %w", res.index, err)
+		}
+		if err := piece.MarkComplete(); err != nil {
+			return err
+		}
+		picker.markDone(res.index)
+		t.downloaded.Add(int64(len(res.buf)))
+		t.broadcastHave(res.index)
 		donePieces++
 
-		Percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		NumWorkers := runtime.NumGoroutine() - 1 // substrat one main thread
-		Index := res.index
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", Percent, Index, NumWorkers)
+		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
+		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, len(t.connectedClients()))
+	}
+	return t.Storage.Flush()
+}
+
+// AddPeers hands newly discovered peers to a running download
+func (t *Torrent) AddPeers(peers []Peer) {
+	if len(peers) == 0 {
+		return
+	}
+	t.peerMu.Lock()
+	t.pendingPeers = append(t.pendingPeers, peers...)
+	t.peerMu.Unlock()
+	select {
+	case t.peerSignal() <- struct{}{}:
+	default: // a wake-up is already pending
+	}
+}
+
+func (t *Torrent) peerSignal() chan struct{} {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	if t.peerNotify == nil {
+		t.peerNotify = make(chan struct{}, 1)
+	}
+	return t.peerNotify
+}
+
+func (t *Torrent) takePendingPeers() []Peer {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	peers := t.pendingPeers
+	t.pendingPeers = nil
+	return peers
+}
+
+// claimPeer records that we are connected to the peer behind c. It fails
+// if we already are, e.g. over IPv4 while this connection is IPv6, or if
+// the connection budget is used up.
+func (t *Torrent) claimPeer(c *Client) error {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	if t.connected == nil {
+		t.connected = make(map[[20]byte]*Client)
+	}
+	if _, ok := t.connected[c.remoteID]; ok {
+		return errAlreadyConnected
+	}
+	if !t.conns.acquire() {
+		return errTooManyConnections
 	}
-	close(workQueue)
+	t.connected[c.remoteID] = c
+	c.downloadLimit = t.downloadLimit
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	c.finished = t.done
+	if t.chokeNotify == nil {
+		t.chokeNotify = make(chan struct{}, 1)
+	}
+	c.uploadMu.Lock()
+	c.interestNotify = t.chokeNotify
+	c.uploadMu.Unlock()
+	return nil
+}
 
-	return buf, nil
+func (t *Torrent) releasePeer(c *Client) {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	if t.connected[c.remoteID] == c {
+		delete(t.connected, c.remoteID)
+		t.conns.release()
+	}
+}
+
+// connectedPeers returns the peers we dialed and are still connected to.
+// Peers that connected to us are left out as we don't know their port.
+func (t *Torrent) connectedPeers() []Peer {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	peers := make([]Peer, 0, len(t.connected))
+	for _, c := range t.connected {
+		if !c.incoming {
+			peers = append(peers, c.peer)
+		}
+	}
+	return peers
+}
+
+// AddConn hands a connection a peer opened to us to the running download.
+// It returns false if the torrent is not downloading, the caller keeps
+// ownership of the connection then.
+func (t *Torrent) AddConn(c *Client) bool {
+	t.peerMu.Lock()
+	if !t.accepting {
+		t.peerMu.Unlock()
+		return false
+	}
+	t.pendingConns = append(t.pendingConns, c)
+	t.peerMu.Unlock()
+	select {
+	case t.peerSignal() <- struct{}{}:
+	default: // a wake-up is already pending
+	}
+	return true
+}
+
+func (t *Torrent) takePendingConns() []*Client {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	conns := t.pendingConns
+	t.pendingConns = nil
+	return conns
+}
+
+// setAccepting opens or closes the download to incoming connections.
+// Connections still waiting when it closes are dropped.
+func (t *Torrent) setAccepting(accepting bool) {
+	t.peerMu.Lock()
+	t.accepting = accepting
+	var dropped []*Client
+	if !accepting {
+		dropped = t.pendingConns
+		t.pendingConns = nil
+	}
+	t.peerMu.Unlock()
+	for _, c := range dropped {
+		c.Conn.Close()
+	}
+}
+
+// dropPendingPeers forgets peers that have not been dialed yet, for
+// example because another peer told us they left the swarm
+func (t *Torrent) dropPendingPeers(peers []Peer) {
+	if len(peers) == 0 {
+		return
+	}
+	dropped := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		dropped[peer.String()] = true
+	}
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	kept := t.pendingPeers[:0]
+	for _, peer := range t.pendingPeers {
+		if !dropped[peer.String()] {
+			kept = append(kept, peer)
+		}
+	}
+	t.pendingPeers = kept
+}
+
+// bitfield returns the pieces we have and verified
+func (t *Torrent) bitfield() Bitfield {
+	bf := make(Bitfield, (len(t.PieceHashes)+7)/8)
+	for index := range t.PieceHashes {
+		if t.Storage.Piece(index).Completed() {
+			bf.SetPiece(index)
+		}
+	}
+	return bf
+}
+
+// bytesLeft is the amount of data we still have to download
+func (t *Torrent) bytesLeft() int64 {
+	left := int64(0)
+	for index := range t.PieceHashes {
+		if !t.Storage.Piece(index).Completed() {
+			left += int64(t.calculatePieceSize(index))
+		}
+	}
+	return left
 }
 
 // ParsePiece parses a PIECE message and copies its payload into a buffer
@@ -0,0 +1,245 @@
+package leecher
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// pexInterval is how often we send a peer our connected peer deltas.
+	// BEP 11 asks for no more than one message a minute.
+	pexInterval = time.Minute
+	// pexMaxPeers caps the added and dropped lists of a message
+	pexMaxPeers = 50
+)
+
+// Flags of an added peer
+const (
+	pexFlagEncryption = 0x01
+	pexFlagSeed       = 0x02
+	pexFlagUTP        = 0x04
+	pexFlagHolepunch  = 0x08
+	pexFlagReachable  = 0x10
+)
+
+// bencodePexMessage is the payload of a ut_pex message. Every list is a
+// string of compact peers, the flags hold one byte per added peer.
+type bencodePexMessage struct {
+	Added    string `bencode:"added,omitempty"`
+	AddedF   string `bencode:"added.f,omitempty"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// pexPeer is a peer learned through ut_pex along with its flags
+type pexPeer struct {
+	Peer
+	flags byte
+}
+
+// pexExtension implements peer exchange (BEP 11). Peers other peers tell us
+// about go to the torrent's download, and every peer that supports ut_pex
+// is told about the peers we are connected to.
+type pexExtension struct {
+	torrent *Torrent
+
+	mu      sync.Mutex
+	running map[*Client]bool
+}
+
+func newPexExtension(t *Torrent) *pexExtension {
+	return &pexExtension{
+		torrent: t,
+		running: make(map[*Client]bool),
+	}
+}
+
+func (p *pexExtension) Name() string {
+	return "ut_pex"
+}
+
+// HandleHandshake starts sending deltas to peers that support ut_pex. A
+// repeated extended handshake does not start a second sender.
+func (p *pexExtension) HandleHandshake(c *Client) error {
+	if !c.SupportsExtension(p.Name()) {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running[c] {
+		return nil
+	}
+	p.running[c] = true
+	go p.run(c)
+	return nil
+}
+
+func (p *pexExtension) HandleMessage(c *Client, payload []byte) error {
+	added, dropped, err := parsePexMessage(payload)
+	if err != nil {
+		return fmt.Errorf("malformed ut_pex message from %s: %w", c.peer, err)
+	}
+
+	// Seeds are worth more to a download than other leechers
+	sort.SliceStable(added, func(i, j int) bool {
+		return added[i].flags&pexFlagSeed > added[j].flags&pexFlagSeed
+	})
+	peers := make([]Peer, len(added))
+	for i, a := range added {
+		peers[i] = a.Peer
+	}
+	p.torrent.dropPendingPeers(dropped)
+	p.torrent.AddPeers(peers)
+	return nil
+}
+
+// run sends the peer the changes to our connected peers every pexInterval
+// until the connection is closed or the torrent is finished. The first
+// message lists every peer we are connected to.
+func (p *pexExtension) run(c *Client) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.running, c)
+		p.mu.Unlock()
+	}()
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	sent := make(map[string]Peer)
+	for {
+		current := make(map[string]Peer)
+		for _, peer := range p.torrent.connectedPeers() {
+			if peer.String() != c.peer.String() {
+				current[peer.String()] = peer
+			}
+		}
+
+		var added, dropped []Peer
+		for key, peer := range current {
+			if _, ok := sent[key]; !ok && len(added) < pexMaxPeers {
+				added = append(added, peer)
+			}
+		}
+		for key, peer := range sent {
+			if _, ok := current[key]; !ok && len(dropped) < pexMaxPeers {
+				dropped = append(dropped, peer)
+			}
+		}
+
+		if len(added) > 0 || len(dropped) > 0 {
+			payload, err := createPexMessage(added, dropped)
+			if err != nil {
+				return
+			}
+			if err := c.SendExtended(p.Name(), payload); err != nil {
+				return // the connection is gone
+			}
+			for _, peer := range added {
+				sent[peer.String()] = peer
+			}
+			for _, peer := range dropped {
+				delete(sent, peer.String())
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-c.closedSignal():
+			return
+		case <-p.torrent.doneSignal():
+			return
+		}
+	}
+}
+
+// createPexMessage encodes a ut_pex message. We only know of peers we
+// dialed ourselves, so every added peer is flagged as reachable.
+func createPexMessage(added, dropped []Peer) ([]byte, error) {
+	var msg bencodePexMessage
+	for _, peer := range added {
+		if peer.IP.To4() != nil {
+			msg.Added += string(peer.compact())
+			msg.AddedF += string([]byte{pexFlagReachable})
+		} else {
+			msg.Added6 += string(peer.compact())
+			msg.Added6F += string([]byte{pexFlagReachable})
+		}
+	}
+	for _, peer := range dropped {
+		if peer.IP.To4() != nil {
+			msg.Dropped += string(peer.compact())
+		} else {
+			msg.Dropped6 += string(peer.compact())
+		}
+	}
+	var buf bytes.Buffer
+	if err := DescodeMarshal(&buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parsePexMessage decodes a ut_pex message. Lists longer than pexMaxPeers
+// are cut short so a single peer can't flood us.
+func parsePexMessage(payload []byte) ([]pexPeer, []Peer, error) {
+	msg := bencodePexMessage{}
+	if err := UnmarshalResponse(bytes.NewReader(payload), &msg); err != nil {
+		return nil, nil, err
+	}
+
+	added, err := unmarshalPexPeers(msg.Added, msg.AddedF, unmarshalPeers)
+	if err != nil {
+		return nil, nil, err
+	}
+	added6, err := unmarshalPexPeers(msg.Added6, msg.Added6F, unmarshalPeers6)
+	if err != nil {
+		return nil, nil, err
+	}
+	dropped, err := unmarshalPeers([]byte(msg.Dropped))
+	if err != nil {
+		return nil, nil, err
+	}
+	dropped6, err := unmarshalPeers6([]byte(msg.Dropped6))
+	if err != nil {
+		return nil, nil, err
+	}
+	return capPexPeers(append(added, added6...)), capPeers(append(dropped, dropped6...)), nil
+}
+
+// unmarshalPexPeers decodes compact peers and attaches their flags. Missing
+// flags are treated as zero.
+func unmarshalPexPeers(compact, flags string, unmarshal func([]byte) ([]Peer, error)) ([]pexPeer, error) {
+	peers, err := unmarshal([]byte(compact))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]pexPeer, 0, len(peers))
+	for i, peer := range peers {
+		if peer.Port == 0 {
+			continue
+		}
+		pp := pexPeer{Peer: peer}
+		if i < len(flags) {
+			pp.flags = flags[i]
+		}
+		result = append(result, pp)
+	}
+	return result, nil
+}
+
+func capPexPeers(peers []pexPeer) []pexPeer {
+	if len(peers) > pexMaxPeers {
+		return peers[:pexMaxPeers]
+	}
+	return peers
+}
+
+func capPeers(peers []Peer) []Peer {
+	if len(peers) > pexMaxPeers {
+		return peers[:pexMaxPeers]
+	}
+	return peers
+}
@@ -0,0 +1,434 @@
+package leecher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// randomFirstPieces is how many pieces are picked at random before the
+// picker switches to rarest first. A complete piece or two lets us trade
+// with other peers sooner than waiting for a rare one.
+const randomFirstPieces = 4
+
+type pieceState uint8
+
+const (
+	piecePending pieceState = iota
+	pieceInProgress
+	pieceDone
+)
+
+// piecePicker hands out the pieces still missing. It knows how many of
+// the connected peers have each piece and hands out the rarest piece the
+// asking peer has.
+type piecePicker struct {
+	mu           sync.Mutex
+	work         []pieceWork
+	state        []pieceState
+	availability []int
+	done         int
+	remaining    int
+	pending      int
+	// active holds the downloads of pieces in progress, and of pending
+	// pieces that were partly downloaded before their peer left
+	active  map[int]*pieceDownload
+	endgame bool
+	rnd     *rand.Rand
+}
+
+// newPiecePicker creates a picker for the pieces of t that are not in
+// storage yet
+func newPiecePicker(t *Torrent) *piecePicker {
+	p := &piecePicker{
+		work:         make([]pieceWork, len(t.PieceHashes)),
+		state:        make([]pieceState, len(t.PieceHashes)),
+		availability: make([]int, len(t.PieceHashes)),
+		active:       make(map[int]*pieceDownload),
+		rnd:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for index, hash := range t.PieceHashes {
+		p.work[index] = pieceWork{index, hash, t.calculatePieceSize(index)}
+		if t.Storage.Piece(index).Completed() {
+			p.state[index] = pieceDone
+			p.done++
+		} else {
+			p.remaining++
+			p.pending++
+		}
+	}
+	return p
+}
+
+// addBitfield counts the pieces of a newly connected peer
+func (p *piecePicker) addBitfield(bf Bitfield) {
+	p.updateBitfield(bf, 1)
+}
+
+// removeBitfield forgets the pieces of a peer that disconnected
+func (p *piecePicker) removeBitfield(bf Bitfield) {
+	p.updateBitfield(bf, -1)
+}
+
+func (p *piecePicker) updateBitfield(bf Bitfield, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index] += delta
+		}
+	}
+}
+
+// addHave counts a piece a peer announced with a Have message
+func (p *piecePicker) addHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// pick hands out a piece the peer of c has that nobody is downloading
+// yet. The first randomFirstPieces pieces are chosen at random, the rarest
+// piece afterwards. Once every missing piece is being downloaded the
+// picker is in endgame mode and lets c join the download of a piece it
+// has, so a slow peer can't hold up the end of the download. It returns
+// nil if the peer has nothing for us right now.
+func (p *piecePicker) pick(c *Client) *pieceDownload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Pieces the peer suggested come first, it probably has them cached
+	for len(c.suggested) > 0 {
+		index := c.suggested[0]
+		c.suggested = c.suggested[1:]
+		if p.state[index] == piecePending && p.canRequest(c, index) {
+			return p.start(index, c)
+		}
+	}
+
+	var candidates []int
+	rarest := 0
+	for index, state := range p.state {
+		if state != piecePending || !p.canRequest(c, index) {
+			continue
+		}
+		switch {
+		case p.done < randomFirstPieces || len(candidates) == 0:
+			if len(candidates) == 0 {
+				rarest = p.availability[index]
+			}
+			candidates = append(candidates, index)
+		case p.availability[index] < rarest:
+			rarest = p.availability[index]
+			candidates = append(candidates[:0], index)
+		case p.availability[index] == rarest:
+			candidates = append(candidates, index)
+		}
+	}
+	if len(candidates) > 0 {
+		// Ties are broken at random so peers don't all chase the same piece
+		return p.start(candidates[p.rnd.Intn(len(candidates))], c)
+	}
+	if p.pending > 0 {
+		return nil
+	}
+
+	// Endgame: join the download with the fewest peers
+	var best *pieceDownload
+	bestPeers := 0
+	for index, pd := range p.active {
+		if p.state[index] != pieceInProgress || !c.canRequest(index) {
+			continue
+		}
+		peers, ok := pd.joinable(c)
+		if ok && (best == nil || peers < bestPeers) {
+			best, bestPeers = pd, peers
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	if !p.endgame {
+		p.endgame = true
+		log.Println("Entering endgame")
+	}
+	best.join(c)
+	return best
+}
+
+// canRequest reports whether c may be asked for blocks of a piece: its
+// peer lets us and hasn't rejected every block of the piece we still
+// need. p.mu is held by the caller.
+func (p *piecePicker) canRequest(c *Client, index int) bool {
+	if !c.canRequest(index) {
+		return false
+	}
+	pd := p.active[index]
+	return pd == nil || !pd.rejectedAll(c)
+}
+
+// start hands the pending piece index to c, reusing blocks downloaded
+// before
+func (p *piecePicker) start(index int, c *Client) *pieceDownload {
+	pd := p.active[index]
+	if pd == nil {
+		pd = newPieceDownload(p.work[index])
+		p.active[index] = pd
+	}
+	p.state[index] = pieceInProgress
+	p.pending--
+	pd.join(c)
+	return pd
+}
+
+// release is called when c stops working on a download. A download
+// nobody works on any more is pending again, the blocks it already has
+// are kept.
+func (p *piecePicker) release(pd *pieceDownload, c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pd.leave(c) == 0 && !pd.complete() && p.state[pd.work.index] == pieceInProgress {
+		p.state[pd.work.index] = piecePending
+		p.pending++
+	}
+}
+
+// reset throws away a piece that failed the integrity check
+func (p *piecePicker) reset(pd *pieceDownload) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.active, pd.work.index)
+	if p.state[pd.work.index] == pieceInProgress {
+		p.state[pd.work.index] = piecePending
+		p.pending++
+	}
+}
+
+// markDone records that a piece has been verified and stored
+func (p *piecePicker) markDone(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] == pieceDone {
+		return
+	}
+	if p.state[index] == piecePending {
+		p.pending--
+	}
+	p.state[index] = pieceDone
+	delete(p.active, index)
+	p.done++
+	p.remaining--
+}
+
+// finished reports whether every piece is done
+func (p *piecePicker) finished() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remaining == 0
+}
+
+// interesting reports whether the peer has a piece we still miss
+func (p *piecePicker) interesting(bf Bitfield) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index, state := range p.state {
+		if state != pieceDone && bf.HasPiece(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// pieceDownload is a piece being downloaded. Outside of endgame only one
+// peer works on it, in endgame several peers share the blocks.
+type pieceDownload struct {
+	mu       sync.Mutex
+	work     pieceWork
+	buf      []byte
+	received []bool
+	missing  int
+	// requested holds the blocks each peer has been asked for and not
+	// delivered yet
+	requested map[*Client]map[int]bool
+	// rejected holds the blocks each peer refused to send us while it
+	// let us request them. They are not asked for again from that peer.
+	rejected map[*Client]map[int]bool
+}
+
+func newPieceDownload(pw pieceWork) *pieceDownload {
+	blocks := (pw.length + maxBlockSize - 1) / maxBlockSize
+	return &pieceDownload{
+		work:      pw,
+		buf:       make([]byte, pw.length),
+		received:  make([]bool, blocks),
+		missing:   blocks,
+		requested: make(map[*Client]map[int]bool),
+		rejected:  make(map[*Client]map[int]bool),
+	}
+}
+
+func (pd *pieceDownload) join(c *Client) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.requested[c] = make(map[int]bool)
+}
+
+// joinable reports how many peers work on the download and whether c may
+// join it
+func (pd *pieceDownload) joinable(c *Client) (int, bool) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	_, joined := pd.requested[c]
+	return len(pd.requested), !joined && pd.missing > 0 && !pd.rejectedAllLocked(c)
+}
+
+// leave removes c from the download and returns how many peers are left
+func (pd *pieceDownload) leave(c *Client) int {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	delete(pd.requested, c)
+	return len(pd.requested)
+}
+
+func (pd *pieceDownload) complete() bool {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	return pd.missing == 0
+}
+
+// outstanding is the number of blocks c has been asked for
+func (pd *pieceDownload) outstanding(c *Client) int {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	return len(pd.requested[c])
+}
+
+// nextBlock returns the next block to request from c. Blocks nobody has
+// been asked for come first, in endgame blocks requested from other peers
+// follow.
+func (pd *pieceDownload) nextBlock(c *Client) (begin, length int, ok bool) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	mine, joined := pd.requested[c]
+	if !joined {
+		return 0, 0, false
+	}
+	pick := -1
+	for block, received := range pd.received {
+		if received || mine[block] || pd.rejected[c][block] {
+			continue
+		}
+		if !pd.requestedByOthers(c, block) {
+			pick = block
+			break
+		}
+		if pick < 0 && len(pd.requested) > 1 {
+			pick = block
+		}
+	}
+	if pick < 0 {
+		return 0, 0, false
+	}
+	mine[pick] = true
+	begin = pick * maxBlockSize
+	length = maxBlockSize
+	if pd.work.length-begin < length {
+		length = pd.work.length - begin
+	}
+	return begin, length, true
+}
+
+func (pd *pieceDownload) requestedByOthers(c *Client, block int) bool {
+	for other, blocks := range pd.requested {
+		if other != c && blocks[block] {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetRequests drops the requests of c, for example because the peer
+// choked us and won't answer them
+func (pd *pieceDownload) forgetRequests(c *Client) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	if _, joined := pd.requested[c]; joined {
+		pd.requested[c] = make(map[int]bool)
+	}
+}
+
+// forgetBlock drops a request of c the peer rejected because it choked us
+func (pd *pieceDownload) forgetBlock(c *Client, begin int) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	delete(pd.requested[c], begin/maxBlockSize)
+}
+
+// blockRejected drops a request of c the peer rejected although it let us
+// request the block, and keeps the block from being asked for again
+func (pd *pieceDownload) blockRejected(c *Client, begin int) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	block := begin / maxBlockSize
+	delete(pd.requested[c], block)
+	if pd.rejected[c] == nil {
+		pd.rejected[c] = make(map[int]bool)
+	}
+	pd.rejected[c][block] = true
+}
+
+// rejectedAll reports whether c rejected every block still missing
+func (pd *pieceDownload) rejectedAll(c *Client) bool {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	return pd.rejectedAllLocked(c)
+}
+
+func (pd *pieceDownload) rejectedAllLocked(c *Client) bool {
+	rejected := pd.rejected[c]
+	if len(rejected) == 0 || pd.missing == 0 {
+		return false
+	}
+	for block, received := range pd.received {
+		if !received && !rejected[block] {
+			return false
+		}
+	}
+	return true
+}
+
+// blockReceived stores a block c sent us. It returns the other peers that
+// were asked for the same block, so their requests can be cancelled, and
+// whether this block completed the piece.
+func (pd *pieceDownload) blockReceived(c *Client, msg *Message) ([]*Client, bool, error) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	block := begin / maxBlockSize
+	if begin%maxBlockSize != 0 || block >= len(pd.received) {
+		return nil, false, fmt.Errorf("unexpected block at offset %d of piece #%d", begin, pd.work.index)
+	}
+	delete(pd.requested[c], block)
+	if pd.received[block] {
+		return nil, false, nil // another peer was faster
+	}
+	if _, err := MParsePiece(pd.work.index, pd.buf, msg); err != nil {
+		return nil, false, err
+	}
+	pd.received[block] = true
+	pd.missing--
+
+	var others []*Client
+	for other, blocks := range pd.requested {
+		if blocks[block] {
+			delete(blocks, block)
+			others = append(others, other)
+		}
+	}
+	return others, pd.missing == 0, nil
+}
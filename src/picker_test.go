@@ -0,0 +1,50 @@
+package leecher
+
+import "testing"
+
+func TestRejectedBlocksAreNotRequestedAgain(t *testing.T) {
+	// One piece of three blocks, the peer has it and unchoked us
+	data := randomData(2*maxBlockSize + 100)
+	tf := newTestTorrentFile(data, len(data), len(data))
+	ts, err := MemoryStorage{}.OpenTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	picker := newPiecePicker(newTestTorrent(tf, ts, 1))
+	c := &Client{Bitfield: Bitfield{0x80}, numPieces: 1}
+
+	pd := picker.pick(c)
+	if pd == nil {
+		t.Fatal("no piece picked")
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, ok := pd.nextBlock(c); !ok {
+			t.Fatalf("block %d not handed out", i)
+		}
+	}
+	pd.blockRejected(c, 0)
+	pd.blockRejected(c, maxBlockSize)
+	if _, _, ok := pd.nextBlock(c); ok {
+		t.Error("a rejected block was handed out again")
+	}
+	if pd.rejectedAll(c) {
+		t.Error("rejectedAll with a block still requested")
+	}
+	pd.blockRejected(c, 2*maxBlockSize)
+	if !pd.rejectedAll(c) {
+		t.Error("every missing block was rejected but rejectedAll is false")
+	}
+
+	// The piece goes back to the picker and is not handed to c again
+	picker.release(pd, c)
+	if picker.pick(c) != nil {
+		t.Error("a piece the peer rejected was picked for it again")
+	}
+	other := &Client{Bitfield: Bitfield{0x80}, numPieces: 1}
+	if picker.pick(other) != pd {
+		t.Error("the rejected piece was not handed to another peer")
+	}
+	if _, _, ok := pd.nextBlock(other); !ok {
+		t.Error("blocks rejected by one peer are not requested from another")
+	}
+}
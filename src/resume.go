@@ -0,0 +1,136 @@
+package leecher
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// bencodeFastResume is what gets persisted next to the data of a torrent so
+// the next run can skip hashing everything again
+type bencodeFastResume struct {
+	InfoHash string              `bencode:"info-hash"`
+	Pieces   string              `bencode:"pieces"`
+	Files    []bencodeResumeFile `bencode:"files"`
+}
+
+type bencodeResumeFile struct {
+	Size  int64 `bencode:"size"`
+	Mtime int64 `bencode:"mtime"`
+}
+
+// checkedStorage is implemented by storage backends that know whether the
+// completion state they loaded can be trusted without a recheck
+type checkedStorage interface {
+	NeedsCheck() bool
+}
+
+func fastResumePath(dir string, infoHash [20]byte) string {
+	return filepath.Join(dir, "."+hex.EncodeToString(infoHash[:])+".resume")
+}
+
+// verifyPieces hashes the data already in storage and marks every piece
+// that matches its hash as complete. It returns the number of complete
+// pieces. Checking stops with ctx.Err() when ctx is cancelled.
+func (t *Torrent) verifyPieces(ctx context.Context) (int, error) {
+	if cs, ok := t.Storage.(checkedStorage); ok && !cs.NeedsCheck() {
+		done := 0
+		for index := range t.PieceHashes {
+			if t.Storage.Piece(index).Completed() {
+				done++
+			}
+		}
+		return done, nil
+	}
+
+	log.Println("Checking existing data for", t.Name)
+	done := 0
+	for index, hash := range t.PieceHashes {
+		if err := ctx.Err(); err != nil {
+			return done, err
+		}
+		piece := t.Storage.Piece(index)
+		if piece.Completed() {
+			done++
+			continue
+		}
+		pw := &pieceWork{index, hash, t.calculatePieceSize(index)}
+		buf := make([]byte, pw.length)
+		if _, err := piece.ReadAt(buf, 0); err != nil {
+			continue
+		}
+		if checkIntegrity(pw, buf) != nil {
+			continue
+		}
+		if err := piece.MarkComplete(); err != nil {
+			continue
+		}
+		done++
+	}
+	log.Printf("Found %d of %d pieces on disk\n", done, len(t.PieceHashes))
+	return done, nil
+}
+
+// loadFastResume restores the completion state saved by a previous run.
+// The state is only used if every file still has the size and modification
+// time recorded with it.
+func (s *fileStorage) loadFastResume() bool {
+	file, err := os.Open(fastResumePath(s.dir, s.tf.InfoHash))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	fr := bencodeFastResume{}
+	if err := UnmarshalResponse(file, &fr); err != nil {
+		return false
+	}
+	if fr.InfoHash != string(s.tf.InfoHash[:]) ||
+		len(fr.Pieces) != len(s.completion.bitfield) ||
+		len(fr.Files) != len(s.handles) {
+		return false
+	}
+	for i, h := range s.handles {
+		info, err := h.Stat()
+		if err != nil {
+			return false
+		}
+		if info.Size() != fr.Files[i].Size || info.ModTime().UnixNano() != fr.Files[i].Mtime {
+			return false
+		}
+	}
+	copy(s.completion.bitfield, fr.Pieces)
+	return true
+}
+
+// saveFastResume records the completion state together with the size and
+// modification time of every file. It must run after the last write.
+func (s *fileStorage) saveFastResume() error {
+	fr := bencodeFastResume{
+		InfoHash: string(s.tf.InfoHash[:]),
+		Files:    make([]bencodeResumeFile, len(s.tf.Files)),
+	}
+	s.completion.mu.Lock()
+	fr.Pieces = string(s.completion.bitfield)
+	s.completion.mu.Unlock()
+
+	for i, f := range s.tf.Files {
+		info, err := os.Stat(filepath.Join(s.dir, filepath.Join(f.Path...)))
+		if err != nil {
+			return err
+		}
+		fr.Files[i] = bencodeResumeFile{
+			Size:  info.Size(),
+			Mtime: info.ModTime().UnixNano(),
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := DescodeMarshal(&buf, fr); err != nil {
+		return err
+	}
+	return os.WriteFile(fastResumePath(s.dir, s.tf.InfoHash), buf.Bytes(), 0644)
+}
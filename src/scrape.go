@@ -0,0 +1,128 @@
+package leecher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+type bencodeScrapeResponse struct {
+	FailureReason string                       `bencode:"failure reason"`
+	Files         map[string]bencodeScrapeFile `bencode:"files"`
+}
+
+type bencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// Scrape asks the trackers of the torrent how many seeders and leechers it
+// has. Trackers are tried tier by tier until one answers.
+func (t *TorrentFile) Scrape() (ScrapeResult, error) {
+	var lastErr error
+	for _, tier := range t.trackerTiers() {
+		for _, tracker := range tier {
+			results, err := Scrape(tracker, [][20]byte{t.InfoHash})
+			if err != nil {
+				log.Printf("Scrape of %s failed: %v\n", tracker, err)
+				lastErr = err
+				continue
+			}
+			return results[0], nil
+		}
+	}
+	if lastErr == nil {
+		return ScrapeResult{}, fmt.Errorf("torrent has no trackers")
+	}
+	return ScrapeResult{}, lastErr
+}
+
+// Scrape asks a single tracker for the statistics of the given infohashes.
+// The results are in the order of infoHashes.
+func Scrape(tracker string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tracker URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(u, infoHashes)
+	case "udp":
+		tr, err := dialUDPTracker(tracker, DefaultUDPTrackerRetries)
+		if err != nil {
+			return nil, err
+		}
+		defer tr.Close()
+		return tr.scrape(infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// scrapeURL derives the scrape URL of an HTTP tracker by replacing the
+// "announce" at the start of the last path element with "scrape"
+func scrapeURL(announce *url.URL) (*url.URL, error) {
+	dir, last := path.Split(announce.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return nil, fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+	u := *announce
+	u.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	return &u, nil
+}
+
+func scrapeHTTP(announce *url.URL, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	u, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scrape response: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scrape response: %w", err)
+	}
+
+	var scrapeResp bencodeScrapeResponse
+	if err := UnmarshalResponse(bytes.NewReader(body), &scrapeResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scrape response: %w", err)
+	}
+	if scrapeResp.FailureReason != "" {
+		return nil, &TrackerError{Tracker: announce.Host, Reason: scrapeResp.FailureReason}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker %s answered with status %s", announce.Host, resp.Status)
+	}
+
+	results := make([]ScrapeResult, len(infoHashes))
+	for i, h := range infoHashes {
+		f, ok := scrapeResp.Files[string(h[:])]
+		if !ok {
+			return nil, fmt.Errorf("tracker %s does not know infohash %x", announce.Host, h)
+		}
+		results[i] = ScrapeResult{
+			InfoHash:   h,
+			Complete:   f.Complete,
+			Incomplete: f.Incomplete,
+			Downloaded: f.Downloaded,
+		}
+	}
+	return results, nil
+}
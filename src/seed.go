@@ -0,0 +1,411 @@
+package leecher
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// maxRequestLength is the largest block a peer may ask for
+	maxRequestLength = 128 * 1024
+	// maxUploadQueue is how many requests of one peer we keep at a time
+	maxUploadQueue = 256
+	// keepAliveInterval is how often an idle connection is kept alive.
+	// Peers drop connections that stay silent for two minutes.
+	keepAliveInterval = 90 * time.Second
+	// serveIdleTimeout is how long a peer may stay silent while we seed
+	serveIdleTimeout = 3 * time.Minute
+)
+
+// SeedLimits tells when to stop seeding. Seeding stops as soon as one of
+// the limits is reached, a zero limit is ignored. With both limits zero we
+// seed until the torrent is stopped.
+type SeedLimits struct {
+	// Ratio is the amount uploaded relative to the torrent's size
+	Ratio float64
+	// Time is how long to seed for
+	Time time.Duration
+}
+
+// DefaultSeedLimits is how long a download keeps seeding after it is done
+var DefaultSeedLimits = SeedLimits{Ratio: 1, Time: 30 * time.Minute}
+
+// errTorrentFinished ends a connection that was waiting when the torrent
+// was finished
+var errTorrentFinished = errors.New("torrent finished")
+
+// blockRequest is a block a peer asked us for
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// Seed uploads verified pieces to peers until one of the limits is
+// reached or ctx is cancelled. Connections left open by Download are
+// reused, peers found while seeding are dialed and peers may connect to
+// us. All connections are closed when Seed returns.
+func (t *Torrent) Seed(ctx context.Context, limits SeedLimits) error {
+	defer t.finishAndWait()
+	if left := t.bytesLeft(); left > 0 {
+		return fmt.Errorf("can't seed %s, %d bytes are missing", t.Name, left)
+	}
+	log.Println("Seeding", t.Name)
+	t.setAccepting(true)
+	defer t.setAccepting(false)
+	stopChoker := make(chan struct{})
+	defer close(stopChoker)
+	go t.runChoker(stopChoker)
+
+	var timeout <-chan time.Time
+	if limits.Time > 0 {
+		timer := time.NewTimer(limits.Time)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	known := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Stopped seeding", t.Name)
+			return ctx.Err()
+		case <-timeout:
+			log.Printf("Seeded %s for %s\n", t.Name, limits.Time)
+			return nil
+		case <-ticker.C:
+			if limits.Ratio > 0 && t.ratio() >= limits.Ratio {
+				log.Printf("Reached a ratio of %0.2f for %s\n", t.ratio(), t.Name)
+				return nil
+			}
+		case <-t.peerSignal():
+			for _, peer := range t.takePendingPeers() {
+				if known[peer.key()] || known[peer.String()] {
+					continue
+				}
+				known[peer.key()] = true
+				known[peer.String()] = true
+				peer := peer
+				t.goWorker(func() { t.seedToPeer(peer) })
+			}
+			for _, c := range t.takePendingConns() {
+				c := c
+				t.goWorker(func() { t.seedToClient(c) })
+			}
+		}
+	}
+}
+
+// ratio is the amount uploaded relative to the torrent's size
+func (t *Torrent) ratio() float64 {
+	if t.Length == 0 {
+		return 0
+	}
+	return float64(t.uploaded.Load()) / float64(t.Length)
+}
+
+func (t *Torrent) doneSignal() chan struct{} {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	return t.done
+}
+
+// finish closes every connection of the torrent
+func (t *Torrent) finish() {
+	done := t.doneSignal()
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	select {
+	case <-done:
+	default:
+		close(done)
+	}
+}
+
+// finishAndWait finishes the torrent and waits until every connection
+// goroutine returned, after which the storage may be closed
+func (t *Torrent) finishAndWait() {
+	t.finish()
+	t.workers.Wait()
+}
+
+// goWorker runs f in a goroutine that finishAndWait waits for. Every
+// goroutine that reads the storage or a connection of the torrent is
+// started with it.
+func (t *Torrent) goWorker(f func()) {
+	t.workers.Add(1)
+	go func() {
+		defer t.workers.Done()
+		f()
+	}()
+}
+
+// closeOnFinish closes the connection of c when the torrent is finished,
+// which unblocks whoever reads it. The returned function stops watching.
+func (t *Torrent) closeOnFinish(c *Client) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-t.doneSignal():
+			c.Conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func (t *Torrent) seedToPeer(peer Peer) {
+	client, err := CliantConnector(peer, t.PeerID, t.InfoHash, t.Extensions, t.bitfield(), len(t.PieceHashes))
+	if err != nil {
+		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
+		return
+	}
+	t.seedToClient(client)
+}
+
+// seedToClient uploads to a peer until the connection breaks or the
+// torrent is finished
+func (t *Torrent) seedToClient(client *Client) {
+	defer client.close()
+	if err := t.claimPeer(client); err != nil {
+		log.Printf("Dropping %s: %v\n", client.peer, err)
+		return
+	}
+	defer t.releasePeer(client)
+	stopUploads := make(chan struct{})
+	defer close(stopUploads)
+	t.goWorker(func() { t.uploadLoop(client, stopUploads) })
+
+	t.serveClient(client)
+}
+
+// serveClient reads the messages of a peer we have nothing left to
+// download from and answers its requests. It returns when the connection
+// fails, the peer is a seed as well or the torrent is finished.
+func (t *Torrent) serveClient(c *Client) {
+	defer t.closeOnFinish(c)()
+
+	for {
+		if t.isSeed(c.Bitfield) {
+			return // neither of us needs anything
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(serveIdleTimeout))
+		msg, err := c.Read()
+		if err != nil {
+			return
+		}
+		if err := c.handleMessage(msg, nil); err != nil {
+			log.Printf("Disconnecting %s: %v\n", c.peer, err)
+			return
+		}
+	}
+}
+
+// isSeed reports whether bf has every piece of the torrent
+func (t *Torrent) isSeed(bf Bitfield) bool {
+	for index := range t.PieceHashes {
+		if !bf.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
+
+// uploadLoop sends the blocks a peer requested and keeps the connection
+// alive until stop is closed
+func (t *Torrent) uploadLoop(c *Client, stop <-chan struct{}) {
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-keepAlive.C:
+			var msg *Message // nil is a keep-alive
+			if _, err := c.Conn.Write(msg.Serialize()); err != nil {
+				return
+			}
+			continue
+		case <-c.uploadSignal():
+		}
+
+		for {
+			req, ok := c.nextRequest()
+			if !ok {
+				break
+			}
+			if err := t.sendBlock(c, req); err != nil {
+				log.Printf("Could not upload to %s: %v\n", c.peer, err)
+				c.Conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// sendBlock reads a requested block from storage and sends it. Only a
+// malformed request is an error: one for a piece we don't have is dropped,
+// or rejected if the peer supports the fast extension, since we may have
+// allowed it to request the piece before we had it.
+func (t *Torrent) sendBlock(c *Client, req blockRequest) error {
+	if req.index < 0 || req.index >= len(t.PieceHashes) {
+		return fmt.Errorf("request for piece #%d out of range", req.index)
+	}
+	if req.begin+req.length > t.calculatePieceSize(req.index) {
+		return fmt.Errorf("request beyond the end of piece #%d", req.index)
+	}
+	piece := t.Storage.Piece(req.index)
+	if !piece.Completed() {
+		c.rejectRequests([]blockRequest{req})
+		return nil
+	}
+	if !t.uploadLimit.wait(req.length, t.doneSignal()) {
+		return nil // the connection is closed with the torrent
+	}
+	block := make([]byte, req.length)
+	if _, err := piece.ReadAt(block, int64(req.begin)); err != nil {
+		return err
+	}
+	if err := c.SendPiece(req.index, req.begin, block); err != nil {
+		return err
+	}
+	t.uploaded.Add(int64(req.length))
+	c.uploadedBytes.Add(int64(req.length))
+	return nil
+}
+
+// broadcastHave tells every connected peer that we have a new piece
+func (t *Torrent) broadcastHave(index int) {
+	for _, c := range t.connectedClients() {
+		c.SendHave(index)
+	}
+}
+
+// handleUploadMessage handles the messages about what a peer wants from
+// us. It reports whether msg was one of them.
+func (c *Client) handleUploadMessage(msg *Message) (bool, error) {
+	switch msg.ID {
+	case MsgInterested, MsgNotInterested:
+		interested := msg.ID == MsgInterested
+		c.uploadMu.Lock()
+		c.peerInterested = interested
+		notify := c.interestNotify
+		c.uploadMu.Unlock()
+		if interested && notify != nil {
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	case MsgRequest:
+		req, err := parseRequest(msg)
+		if err != nil {
+			return true, err
+		}
+		c.queueRequest(req)
+	case MsgCancel:
+		req, err := parseRequest(msg)
+		if err != nil {
+			return true, err
+		}
+		c.cancelRequest(req)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// queueRequest queues a request for upload. Requests from a peer we choke
+// are ignored, unless they are for an allowed fast piece. A fast peer is
+// told about ignored requests.
+func (c *Client) queueRequest(req blockRequest) {
+	c.uploadMu.Lock()
+	allowed := c.peerUnchoked || (c.supportsFast && c.allowedFastOut[req.index])
+	if !allowed || len(c.uploads) >= maxUploadQueue {
+		c.uploadMu.Unlock()
+		c.rejectRequests([]blockRequest{req})
+		return
+	}
+	for _, queued := range c.uploads {
+		if queued == req {
+			c.uploadMu.Unlock()
+			return
+		}
+	}
+	c.uploads = append(c.uploads, req)
+	c.uploadMu.Unlock()
+
+	select {
+	case c.uploadSignal() <- struct{}{}:
+	default:
+	}
+}
+
+// cancelRequest drops a request that has not been sent yet. A fast peer
+// expects a Reject for it.
+func (c *Client) cancelRequest(req blockRequest) {
+	c.uploadMu.Lock()
+	for i, queued := range c.uploads {
+		if queued == req {
+			c.uploads = append(c.uploads[:i], c.uploads[i+1:]...)
+			c.uploadMu.Unlock()
+			c.rejectRequests([]blockRequest{req})
+			return
+		}
+	}
+	c.uploadMu.Unlock()
+}
+
+func (c *Client) nextRequest() (blockRequest, bool) {
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+	if len(c.uploads) == 0 {
+		return blockRequest{}, false
+	}
+	req := c.uploads[0]
+	c.uploads = c.uploads[1:]
+	return req, true
+}
+
+func (c *Client) uploadSignal() chan struct{} {
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+	if c.uploadNotify == nil {
+		c.uploadNotify = make(chan struct{}, 1)
+	}
+	return c.uploadNotify
+}
+
+// parseRequest parses a REQUEST or CANCEL message
+func parseRequest(msg *Message) (blockRequest, error) {
+	if len(msg.Payload) != 12 {
+		return blockRequest{}, fmt.Errorf("expected payload length 12, got length %d", len(msg.Payload))
+	}
+	req := blockRequest{
+		index:  int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+		length: int(binary.BigEndian.Uint32(msg.Payload[8:12])),
+	}
+	if req.length <= 0 || req.length > maxRequestLength {
+		return blockRequest{}, errors.New("invalid request length")
+	}
+	return req, nil
+}
+
+// createPieceMessage creates a PIECE message
+func createPieceMessage(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
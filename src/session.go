@@ -0,0 +1,492 @@
+package leecher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TorrentState is what a torrent of a Session is doing
+type TorrentState int
+
+const (
+	// StateChecking is set while the data already in storage is verified
+	StateChecking TorrentState = iota
+	// StateDownloading is set while pieces are missing
+	StateDownloading
+	// StateSeeding is set once every piece is there
+	StateSeeding
+	// StatePaused is set when the torrent was paused or reached its seed
+	// limits
+	StatePaused
+	// StateError is set when the torrent stopped because of an error
+	StateError
+)
+
+func (s TorrentState) String() string {
+	switch s {
+	case StateChecking:
+		return "checking"
+	case StateDownloading:
+		return "downloading"
+	case StateSeeding:
+		return "seeding"
+	case StatePaused:
+		return "paused"
+	case StateError:
+		return "error"
+	default:
+		return fmt.Sprintf("TorrentState(%d)", int(s))
+	}
+}
+
+// ErrUnknownTorrent is returned for an infohash that is not in the session
+var ErrUnknownTorrent = errors.New("torrent not in session")
+
+// ErrSessionClosed is returned when adding a torrent to a closed session
+var ErrSessionClosed = errors.New("session closed")
+
+// SessionConfig holds the settings of a Session
+type SessionConfig struct {
+	// ListenAddr is where peers connect to us, ":6881" if empty
+	ListenAddr string
+	// Storage keeps the data of the torrents, FileStorage in the working
+	// directory if nil
+	Storage Storage
+	// SeedLimits tells when a finished torrent stops seeding and is
+	// paused. The zero value seeds until the torrent is paused or removed.
+	SeedLimits SeedLimits
+	// MaxConnections limits the peer connections of all torrents together,
+	// zero means no limit
+	MaxConnections int
+	// DownloadRate and UploadRate limit the bytes per second of all
+	// torrents together, zero means no limit
+	DownloadRate int64
+	UploadRate   int64
+	// DisableDHT and DisableLSD turn off peer discovery through the DHT
+	// and local service discovery
+	DisableDHT bool
+	DisableLSD bool
+	// UDPTrackerRetries is how often a request to a UDP tracker is resent,
+	// n in the 15*2^n second timeout of BEP 15. It is at most 8, the
+	// limit of BEP 15, and DefaultUDPTrackerRetries if zero.
+	UDPTrackerRetries int
+	// UploadSlots is how many peers of every torrent the choker unchokes
+	// for their rate, DefaultUploadSlots if zero
+	UploadSlots int
+	// MinPeers is how many connections a download tries to keep,
+	// DefaultMinPeers if zero
+	MinPeers int
+	// StallTimeout is how long a download waits for data before it gives
+	// up, DefaultStallTimeout if zero
+	StallTimeout time.Duration
+}
+
+// TorrentStatus describes a torrent of a Session
+type TorrentStatus struct {
+	InfoHash [20]byte
+	Name     string
+	State    TorrentState
+	// Err is why the torrent stopped if State is StateError
+	Err error
+	// Downloaded and Uploaded count the bytes of the current run
+	Downloaded int64
+	Uploaded   int64
+}
+
+// Session runs many torrents at once. The torrents share a peer ID, the
+// listening port, the DHT node and local service discovery, and the
+// connection and bandwidth limits of the session.
+type Session struct {
+	config   SessionConfig
+	peerID   [20]byte
+	port     uint16
+	listener *Listener
+	dht      *DHT
+	lsd      *LSD
+
+	conns         *connBudget
+	downloadLimit *rateLimiter
+	uploadLimit   *rateLimiter
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*sessionTorrent
+	closed   bool
+}
+
+// sessionTorrent is a torrent of a session and its current run
+type sessionTorrent struct {
+	tf     TorrentFile
+	limits SeedLimits
+	// seedOnly refuses to download, the data must be complete
+	seedOnly bool
+	// stopIfComplete skips seeding when the data is complete from the
+	// start
+	stopIfComplete bool
+
+	// ctl serializes starting and stopping the torrent
+	ctl sync.Mutex
+
+	mu      sync.Mutex
+	state   TorrentState
+	err     error
+	torrent *Torrent
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewSession starts the services shared by the torrents of a session. If
+// the listen address is taken the session still works, but peers can't
+// connect to us.
+func NewSession(config SessionConfig) (*Session, error) {
+	peerID, err := generatePeerID()
+	if err != nil {
+		return nil, err
+	}
+	if config.Storage == nil {
+		config.Storage = FileStorage{Dir: "."}
+	}
+	s := &Session{
+		config:        config,
+		peerID:        peerID,
+		port:          DefaultPort,
+		conns:         newConnBudget(config.MaxConnections),
+		downloadLimit: newRateLimiter(config.DownloadRate),
+		uploadLimit:   newRateLimiter(config.UploadRate),
+		torrents:      make(map[[20]byte]*sessionTorrent),
+	}
+
+	addr := config.ListenAddr
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", DefaultPort)
+	}
+	if ln, err := Listen(addr); err != nil {
+		log.Println("Not accepting peer connections:", err)
+	} else {
+		s.listener = ln
+		if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok {
+			s.port = uint16(tcpAddr.Port)
+		}
+	}
+	if !config.DisableDHT {
+		s.dht = startDHT(s.port)
+	}
+	if !config.DisableLSD {
+		if lsd, err := NewLSD(s.port); err != nil {
+			log.Println("Could not start local service discovery:", err)
+		} else {
+			s.lsd = lsd
+		}
+	}
+	return s, nil
+}
+
+// Add adds a torrent to the session and starts it
+func (s *Session) Add(tf TorrentFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if _, ok := s.torrents[tf.InfoHash]; ok {
+		return fmt.Errorf("torrent %x is already in the session", tf.InfoHash)
+	}
+	st := &sessionTorrent{tf: tf, limits: s.config.SeedLimits}
+	s.torrents[tf.InfoHash] = st
+	st.ctl.Lock()
+	defer st.ctl.Unlock()
+	s.start(st)
+	return nil
+}
+
+// Remove stops a torrent and removes it from the session. Its data is
+// kept.
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+	st, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	st.ctl.Lock()
+	defer st.ctl.Unlock()
+	st.stop()
+	return nil
+}
+
+// Pause stops a torrent until it is resumed. Its peers are disconnected
+// and the trackers are told that we stopped.
+func (s *Session) Pause(infoHash [20]byte) error {
+	st, err := s.get(infoHash)
+	if err != nil {
+		return err
+	}
+	st.ctl.Lock()
+	defer st.ctl.Unlock()
+	st.stop()
+	return nil
+}
+
+// Resume restarts a paused torrent or one that stopped because of an
+// error. Resuming a running torrent does nothing.
+func (s *Session) Resume(infoHash [20]byte) error {
+	st, err := s.get(infoHash)
+	if err != nil {
+		return err
+	}
+	st.ctl.Lock()
+	defer st.ctl.Unlock()
+	if !st.running() {
+		s.start(st)
+	}
+	return nil
+}
+
+// Status reports the state of a torrent
+func (s *Session) Status(infoHash [20]byte) (TorrentStatus, error) {
+	st, err := s.get(infoHash)
+	if err != nil {
+		return TorrentStatus{}, err
+	}
+	return st.status(), nil
+}
+
+// Torrents reports the state of every torrent, sorted by name
+func (s *Session) Torrents() []TorrentStatus {
+	s.mu.Lock()
+	statuses := make([]TorrentStatus, 0, len(s.torrents))
+	for _, st := range s.torrents {
+		statuses = append(statuses, st.status())
+	}
+	s.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// Close stops every torrent and the services of the session
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	torrents := make([]*sessionTorrent, 0, len(s.torrents))
+	for _, st := range s.torrents {
+		torrents = append(torrents, st)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, st := range torrents {
+		wg.Add(1)
+		go func(st *sessionTorrent) {
+			defer wg.Done()
+			st.ctl.Lock()
+			defer st.ctl.Unlock()
+			st.stop()
+		}(st)
+	}
+	wg.Wait()
+
+	if s.lsd != nil {
+		s.lsd.Close()
+	}
+	if s.dht != nil {
+		s.dht.shutdown()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Session) get(infoHash [20]byte) (*sessionTorrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.torrents[infoHash]
+	if !ok {
+		return nil, ErrUnknownTorrent
+	}
+	return st, nil
+}
+
+// start runs a torrent in the background. The caller holds st.ctl.
+func (s *Session) start(st *sessionTorrent) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	st.mu.Lock()
+	st.state, st.err = StateChecking, nil
+	st.cancel, st.done = cancel, done
+	st.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		err := s.run(ctx, st)
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Stopped %s: %v\n", st.tf.Name, err)
+			st.state, st.err = StateError, err
+		} else {
+			st.state = StatePaused
+		}
+	}()
+}
+
+// run verifies the data of a torrent, downloads what is missing and
+// seeds it until its seed limits are reached or ctx is cancelled
+func (s *Session) run(ctx context.Context, st *sessionTorrent) error {
+	tf := &st.tf
+	torrent, err := s.newTorrent(tf)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	st.torrent = torrent
+	st.mu.Unlock()
+
+	ts, err := s.config.Storage.OpenTorrent(tf)
+	if err != nil {
+		return err
+	}
+	defer ts.Close()
+	torrent.Storage = ts
+
+	done, err := torrent.verifyPieces(ctx)
+	if err != nil {
+		return err // paused while checking
+	}
+	complete := done == len(tf.PieceHashes)
+	if st.seedOnly && !complete {
+		return fmt.Errorf("can't seed %s, its data is incomplete", tf.Name)
+	}
+	if complete && st.stopIfComplete {
+		log.Println("Nothing left to download for", tf.Name)
+		return ts.Flush()
+	}
+	// Connections still serving peers read the storage, so wait for them
+	// before it is closed
+	defer torrent.finishAndWait()
+
+	if s.listener != nil {
+		s.listener.Add(torrent)
+		defer s.listener.Remove(tf.InfoHash)
+	}
+
+	ann, err := newAnnouncer(tf, torrent, s.port, s.config.UDPTrackerRetries)
+	if err != nil {
+		return err
+	}
+	peers, err := ann.start(ctx)
+	defer ann.stop()
+	if err != nil {
+		if s.dht == nil {
+			return err
+		}
+		log.Println("Announce failed, relying on the DHT:", err)
+	}
+	torrent.Peers = peers
+
+	if s.dht != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go s.dht.feedPeers(torrent, s.port, stop)
+	}
+	if s.lsd != nil {
+		s.lsd.Add(torrent)
+		defer s.lsd.Remove(tf.InfoHash)
+	}
+
+	if !complete {
+		st.setState(StateDownloading)
+		if err := torrent.Download(ctx); err != nil {
+			return err
+		}
+		ann.completed()
+	}
+	st.setState(StateSeeding)
+	return torrent.Seed(ctx, st.limits)
+}
+
+// newTorrent creates the Torrent for a run of tf, sharing the peer ID and
+// limits of the session
+func (s *Session) newTorrent(tf *TorrentFile) (*Torrent, error) {
+	torrent := &Torrent{
+		PeerID:        s.peerID,
+		InfoHash:      tf.InfoHash,
+		PieceHashes:   tf.PieceHashes,
+		PieceLength:   tf.PieceLength,
+		Length:        tf.Length,
+		Name:          tf.Name,
+		Extensions:    NewExtensionRegistry(),
+		UploadSlots:   s.config.UploadSlots,
+		MinPeers:      s.config.MinPeers,
+		StallTimeout:  s.config.StallTimeout,
+		conns:         s.conns,
+		downloadLimit: s.downloadLimit,
+		uploadLimit:   s.uploadLimit,
+	}
+	if err := torrent.Extensions.Register(newPexExtension(torrent)); err != nil {
+		return nil, err
+	}
+	return torrent, nil
+}
+
+func (st *sessionTorrent) setState(state TorrentState) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.state = state
+}
+
+func (st *sessionTorrent) running() bool {
+	st.mu.Lock()
+	done := st.done
+	st.mu.Unlock()
+	if done == nil {
+		return false
+	}
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop cancels the current run and waits for it to end. The caller holds
+// st.ctl.
+func (st *sessionTorrent) stop() {
+	st.mu.Lock()
+	cancel, done := st.cancel, st.done
+	st.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (st *sessionTorrent) status() TorrentStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	status := TorrentStatus{
+		InfoHash: st.tf.InfoHash,
+		Name:     st.tf.Name,
+		State:    st.state,
+		Err:      st.err,
+	}
+	if st.torrent != nil {
+		status.Downloaded = st.torrent.downloaded.Load()
+		status.Uploaded = st.torrent.uploaded.Load()
+	}
+	return status
+}
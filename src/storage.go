@@ -0,0 +1,346 @@
+package leecher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage opens the backing store for the data of a torrent
+type Storage interface {
+	OpenTorrent(tf *TorrentFile) (TorrentStorage, error)
+}
+
+// TorrentStorage holds the data of a single torrent
+type TorrentStorage interface {
+	// Piece returns the storage of the piece at index
+	Piece(index int) PieceStorage
+	// Flush makes sure everything written so far has reached the backend
+	Flush() error
+	Close() error
+}
+
+// PieceStorage reads and writes a single piece. Offsets are relative to the
+// start of the piece.
+type PieceStorage interface {
+	io.ReaderAt
+	io.WriterAt
+	// MarkComplete records that the piece has been verified
+	MarkComplete() error
+	Completed() bool
+}
+
+// torrentData is the flat view of a torrent's data every backend provides
+type torrentData interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// pieceCompletion keeps track of the verified pieces of a torrent
+type pieceCompletion struct {
+	mu       sync.Mutex
+	bitfield Bitfield
+}
+
+func newPieceCompletion(numPieces int) *pieceCompletion {
+	return &pieceCompletion{bitfield: make(Bitfield, (numPieces+7)/8)}
+}
+
+func (c *pieceCompletion) set(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bitfield.SetPiece(index)
+}
+
+func (c *pieceCompletion) has(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bitfield.HasPiece(index)
+}
+
+// storagePiece maps a piece onto the flat data of its torrent
+type storagePiece struct {
+	data       torrentData
+	completion *pieceCompletion
+	index      int
+	offset     int64
+	length     int64
+}
+
+func newStoragePiece(tf *TorrentFile, data torrentData, completion *pieceCompletion, index int) *storagePiece {
+	begin := int64(index) * int64(tf.PieceLength)
+	end := begin + int64(tf.PieceLength)
+	if end > int64(tf.Length) {
+		end = int64(tf.Length)
+	}
+	return &storagePiece{
+		data:       data,
+		completion: completion,
+		index:      index,
+		offset:     begin,
+		length:     end - begin,
+	}
+}
+
+func (p *storagePiece) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || off >= p.length {
+		return 0, io.EOF
+	}
+	if rest := p.length - off; int64(len(b)) > rest {
+		n, err := p.data.ReadAt(b[:rest], p.offset+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return p.data.ReadAt(b, p.offset+off)
+}
+
+func (p *storagePiece) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > p.length {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside piece #%d", len(b), off, p.index)
+	}
+	return p.data.WriteAt(b, p.offset+off)
+}
+
+func (p *storagePiece) MarkComplete() error {
+	p.completion.set(p.index)
+	return nil
+}
+
+func (p *storagePiece) Completed() bool {
+	return p.completion.has(p.index)
+}
+
+// forEachFileSpan calls fn for every file that the range [off, off+n) of
+// the torrent data overlaps. fileOff is the offset inside the file and
+// [from, to) the matching part of the range.
+func forEachFileSpan(files []File, off int64, n int, fn func(i int, fileOff int64, from, to int) error) error {
+	for i, f := range files {
+		start, end := int64(f.Offset), int64(f.Offset+f.Length)
+		if off >= end || off+int64(n) <= start {
+			continue
+		}
+		from := int64(0)
+		if start > off {
+			from = start - off
+		}
+		to := int64(n)
+		if off+to > end {
+			to = end - off
+		}
+		if err := fn(i, off+from-start, int(from), int(to)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileStorage keeps torrent data in regular files below Dir
+type FileStorage struct {
+	Dir string
+}
+
+func (s FileStorage) OpenTorrent(tf *TorrentFile) (TorrentStorage, error) {
+	fs, err := openFileStorage(s.Dir, tf)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// fileStorage writes piece data straight into the files of a torrent, so a
+// piece is on disk as soon as it has been verified
+type fileStorage struct {
+	dir        string
+	tf         *TorrentFile
+	handles    []*os.File
+	completion *pieceCompletion
+	needsCheck bool
+	opened     bool
+}
+
+// openFileStorage creates (or reopens) every file of the torrent below dir
+// and sizes it to its final length. The completion state of a previous run
+// is restored from the fast-resume file when it is still valid.
+func openFileStorage(dir string, tf *TorrentFile) (*fileStorage, error) {
+	s := &fileStorage{
+		dir:        dir,
+		tf:         tf,
+		handles:    make([]*os.File, len(tf.Files)),
+		completion: newPieceCompletion(len(tf.PieceHashes)),
+	}
+	existing := false
+	for i, f := range tf.Files {
+		path := filepath.Join(dir, filepath.Join(f.Path...))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			s.Close()
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			existing = true
+		}
+		h, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles[i] = h
+	}
+
+	// Load before resizing, truncating touches the modification time
+	s.needsCheck = existing && !s.loadFastResume()
+
+	for i, f := range tf.Files {
+		info, err := s.handles[i].Stat()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if info.Size() == int64(f.Length) {
+			continue
+		}
+		if err := s.handles[i].Truncate(int64(f.Length)); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	s.opened = true
+	return s, nil
+}
+
+// NeedsCheck reports whether data from an earlier run has to be hashed
+// before it can be trusted
+func (s *fileStorage) NeedsCheck() bool {
+	return s.needsCheck
+}
+
+func (s *fileStorage) Piece(index int) PieceStorage {
+	return newStoragePiece(s.tf, s, s.completion, index)
+}
+
+// ReadAt reads p from offset off of the torrent data
+func (s *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	err := forEachFileSpan(s.tf.Files, off, len(p), func(i int, fileOff int64, from, to int) error {
+		n, err := s.handles[i].ReadAt(p[from:to], fileOff)
+		read += n
+		return err
+	})
+	return read, err
+}
+
+// WriteAt writes p at offset off of the torrent data, splitting it over
+// every file the range touches
+func (s *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	err := forEachFileSpan(s.tf.Files, off, len(p), func(i int, fileOff int64, from, to int) error {
+		n, err := s.handles[i].WriteAt(p[from:to], fileOff)
+		written += n
+		return err
+	})
+	return written, err
+}
+
+// Flush syncs every file to disk
+func (s *fileStorage) Flush() error {
+	for _, h := range s.handles {
+		if h == nil {
+			continue
+		}
+		if err := h.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all files of the torrent and saves the fast-resume state
+func (s *fileStorage) Close() error {
+	var firstErr error
+	for i, h := range s.handles {
+		if h == nil {
+			continue
+		}
+		if err := h.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.handles[i] = nil
+	}
+	if s.opened && firstErr == nil {
+		firstErr = s.saveFastResume()
+	}
+	s.opened = false
+	return firstErr
+}
+
+// MemoryStorage keeps torrent data in memory. It is meant for tests and
+// small torrents.
+type MemoryStorage struct{}
+
+func (MemoryStorage) OpenTorrent(tf *TorrentFile) (TorrentStorage, error) {
+	return &memoryStorage{
+		tf:         tf,
+		buf:        make([]byte, tf.Length),
+		completion: newPieceCompletion(len(tf.PieceHashes)),
+	}, nil
+}
+
+type memoryStorage struct {
+	tf         *TorrentFile
+	mu         sync.RWMutex
+	buf        []byte
+	completion *pieceCompletion
+}
+
+func (s *memoryStorage) Piece(index int) PieceStorage {
+	return newStoragePiece(s.tf, s, s.completion, index)
+}
+
+func (s *memoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if off < 0 || off >= int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off < 0 || off+int64(len(p)) > int64(len(s.buf)) {
+		return 0, errors.New("write outside of torrent data")
+	}
+	return copy(s.buf[off:], p), nil
+}
+
+// NeedsCheck is false since a new memory storage never holds any data
+func (s *memoryStorage) NeedsCheck() bool {
+	return false
+}
+
+func (s *memoryStorage) Flush() error {
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+// MmapStorage keeps torrent data in files below Dir that are mapped into
+// memory. It is only available on Linux.
+type MmapStorage struct {
+	Dir string
+}
+
+func (s MmapStorage) OpenTorrent(tf *TorrentFile) (TorrentStorage, error) {
+	return openMmapStorage(s.Dir, tf)
+}
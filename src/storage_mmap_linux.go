@@ -0,0 +1,105 @@
+//go:build linux
+
+package leecher
+
+import (
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+// mmapStorage maps every file of a torrent into memory
+type mmapStorage struct {
+	files      *fileStorage
+	maps       [][]byte
+	completion *pieceCompletion
+}
+
+func openMmapStorage(dir string, tf *TorrentFile) (TorrentStorage, error) {
+	files, err := openFileStorage(dir, tf)
+	if err != nil {
+		return nil, err
+	}
+	s := &mmapStorage{
+		files:      files,
+		maps:       make([][]byte, len(tf.Files)),
+		completion: files.completion,
+	}
+	for i, f := range tf.Files {
+		if f.Length == 0 {
+			continue // empty files cannot be mapped
+		}
+		fd := int(files.handles[i].Fd())
+		m, err := syscall.Mmap(fd, 0, f.Length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.maps[i] = m
+	}
+	return s, nil
+}
+
+func (s *mmapStorage) Piece(index int) PieceStorage {
+	return newStoragePiece(s.files.tf, s, s.completion, index)
+}
+
+func (s *mmapStorage) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	err := forEachFileSpan(s.files.tf.Files, off, len(p), func(i int, fileOff int64, from, to int) error {
+		read += copy(p[from:to], s.maps[i][fileOff:])
+		return nil
+	})
+	if err == nil && read < len(p) {
+		err = io.EOF
+	}
+	return read, err
+}
+
+func (s *mmapStorage) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	err := forEachFileSpan(s.files.tf.Files, off, len(p), func(i int, fileOff int64, from, to int) error {
+		written += copy(s.maps[i][fileOff:], p[from:to])
+		return nil
+	})
+	if err == nil && written < len(p) {
+		err = io.ErrShortWrite
+	}
+	return written, err
+}
+
+func (s *mmapStorage) NeedsCheck() bool {
+	return s.files.NeedsCheck()
+}
+
+// Flush writes dirty pages back to the files
+func (s *mmapStorage) Flush() error {
+	for _, m := range s.maps {
+		if len(m) == 0 {
+			continue
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+			uintptr(unsafe.Pointer(&m[0])), uintptr(len(m)), syscall.MS_SYNC)
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+func (s *mmapStorage) Close() error {
+	var firstErr error
+	for i, m := range s.maps {
+		if m == nil {
+			continue
+		}
+		if err := syscall.Munmap(m); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.maps[i] = nil
+	}
+	if err := s.files.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
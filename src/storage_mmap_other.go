@@ -0,0 +1,9 @@
+//go:build !linux
+
+package leecher
+
+import "errors"
+
+func openMmapStorage(dir string, tf *TorrentFile) (TorrentStorage, error) {
+	return nil, errors.New("mmap storage is only supported on linux")
+}
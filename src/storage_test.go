@@ -0,0 +1,283 @@
+package leecher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestTorrentFile describes data split into files of the given lengths
+func newTestTorrentFile(data []byte, pieceLength int, fileLengths ...int) *TorrentFile {
+	tf := &TorrentFile{
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "test",
+		InfoHash:    sha1.Sum(data),
+	}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		tf.PieceHashes = append(tf.PieceHashes, sha1.Sum(data[begin:end]))
+	}
+	offset := 0
+	for i, length := range fileLengths {
+		tf.Files = append(tf.Files, File{
+			Path:   []string{"test", string(rune('a' + i))},
+			Length: length,
+			Offset: offset,
+		})
+		offset += length
+	}
+	return tf
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func pieceData(tf *TorrentFile, data []byte, index int) []byte {
+	begin := index * tf.PieceLength
+	end := begin + tf.PieceLength
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[begin:end]
+}
+
+// writePieces writes the given pieces of data and marks them complete
+func writePieces(t *testing.T, ts TorrentStorage, tf *TorrentFile, data []byte, indexes ...int) {
+	t.Helper()
+	for _, index := range indexes {
+		piece := ts.Piece(index)
+		if _, err := piece.WriteAt(pieceData(tf, data, index), 0); err != nil {
+			t.Fatalf("write piece #%d: %v", index, err)
+		}
+		if err := piece.MarkComplete(); err != nil {
+			t.Fatalf("mark piece #%d: %v", index, err)
+		}
+	}
+}
+
+// checkPieces reads every piece back and compares it with data
+func checkPieces(t *testing.T, ts TorrentStorage, tf *TorrentFile, data []byte) {
+	t.Helper()
+	for index := range tf.PieceHashes {
+		want := pieceData(tf, data, index)
+		got := make([]byte, len(want))
+		if _, err := ts.Piece(index).ReadAt(got, 0); err != nil {
+			t.Fatalf("read piece #%d: %v", index, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("piece #%d does not match what was written", index)
+		}
+	}
+}
+
+func allPieces(tf *TorrentFile) []int {
+	indexes := make([]int, len(tf.PieceHashes))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+func TestMemoryStorageRoundTrip(t *testing.T) {
+	data := randomData(10000)
+	tf := newTestTorrentFile(data, 4096, len(data))
+	ts, err := MemoryStorage{}.OpenTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	writePieces(t, ts, tf, data, 0, 2)
+	if !ts.Piece(0).Completed() || ts.Piece(1).Completed() || !ts.Piece(2).Completed() {
+		t.Error("completion does not match the pieces marked complete")
+	}
+	writePieces(t, ts, tf, data, 1)
+	checkPieces(t, ts, tf, data)
+
+	// The last piece is shorter than the piece length
+	last := ts.Piece(2)
+	buf := make([]byte, tf.PieceLength)
+	n, err := last.ReadAt(buf, 0)
+	if n != len(data)-2*tf.PieceLength || err != io.EOF {
+		t.Errorf("reading past the last piece got %d, %v", n, err)
+	}
+	if _, err := last.WriteAt(buf, 0); err == nil {
+		t.Error("write past the end of the last piece succeeded")
+	}
+}
+
+// testSpanningPieces writes pieces that cross file boundaries and checks
+// both the pieces and the files on disk
+func testSpanningPieces(t *testing.T, storage Storage, dir string) {
+	data := randomData(9011)
+	// Files shorter than a piece, an empty one and one spanning pieces
+	tf := newTestTorrentFile(data, 1024, 10, 3000, 0, 1, 6000)
+	ts, err := storage.OpenTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePieces(t, ts, tf, data, allPieces(tf)...)
+	checkPieces(t, ts, tf, data)
+	if err := ts.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range tf.Files {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.Join(f.Path...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data[f.Offset:f.Offset+f.Length]) {
+			t.Errorf("file %s does not hold its part of the data", filepath.Join(f.Path...))
+		}
+	}
+}
+
+func TestFileStorageSpanningPieces(t *testing.T) {
+	dir := t.TempDir()
+	testSpanningPieces(t, FileStorage{Dir: dir}, dir)
+}
+
+func TestMmapStorageSpanningPieces(t *testing.T) {
+	dir := t.TempDir()
+	tf := newTestTorrentFile([]byte{0}, 1, 1)
+	ts, err := MmapStorage{Dir: t.TempDir()}.OpenTorrent(tf)
+	if err != nil {
+		t.Skip("mmap storage not available:", err)
+	}
+	ts.Close()
+	testSpanningPieces(t, MmapStorage{Dir: dir}, dir)
+}
+
+func TestFastResume(t *testing.T) {
+	dir := t.TempDir()
+	data := randomData(5000)
+	tf := newTestTorrentFile(data, 1024, 2000, 3000)
+
+	ts, err := FileStorage{Dir: dir}.OpenTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePieces(t, ts, tf, data, 0, 2, 4)
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err = FileStorage{Dir: dir}.OpenTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.(checkedStorage).NeedsCheck() {
+		t.Error("valid fast-resume state was not used")
+	}
+	for index := range tf.PieceHashes {
+		if want := index%2 == 0; ts.Piece(index).Completed() != want {
+			t.Errorf("piece #%d completed = %v, want %v", index, !want, want)
+		}
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file changed behind our back invalidates the saved state
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "test", "a"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	ts, err = FileStorage{Dir: dir}.OpenTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	if !ts.(checkedStorage).NeedsCheck() {
+		t.Fatal("stale fast-resume state was used")
+	}
+	torrent := &Torrent{
+		PieceHashes: tf.PieceHashes,
+		PieceLength: tf.PieceLength,
+		Length:      tf.Length,
+		Name:        tf.Name,
+		Storage:     ts,
+	}
+	done, err := torrent.verifyPieces(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done != 3 {
+		t.Errorf("recheck found %d complete pieces, want 3", done)
+	}
+}
+
+func newTestTorrent(tf *TorrentFile, ts TorrentStorage, peerID byte) *Torrent {
+	return &Torrent{
+		PeerID:      [20]byte{peerID},
+		InfoHash:    tf.InfoHash,
+		PieceHashes: tf.PieceHashes,
+		PieceLength: tf.PieceLength,
+		Length:      tf.Length,
+		Name:        tf.Name,
+		Storage:     ts,
+		Extensions:  NewExtensionRegistry(),
+	}
+}
+
+func TestDownloadFromSeeder(t *testing.T) {
+	data := randomData(150000)
+	tf := newTestTorrentFile(data, 32768, len(data))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	seedStorage, err := MemoryStorage{}.OpenTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seedStorage.Close()
+	writePieces(t, seedStorage, tf, data, allPieces(tf)...)
+	seed := newTestTorrent(tf, seedStorage, 1)
+
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Add(seed)
+	seed.setAccepting(true) // before the leecher dials
+	seeded := make(chan error, 1)
+	go func() { seeded <- seed.Seed(ctx, SeedLimits{}) }()
+
+	leechStorage, err := MemoryStorage{}.OpenTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leechStorage.Close()
+	leech := newTestTorrent(tf, leechStorage, 2)
+	addr := l.Addr().(*net.TCPAddr)
+	leech.Peers = []Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+	if err := leech.Download(ctx); err != nil {
+		t.Fatal(err)
+	}
+	leech.finishAndWait()
+	checkPieces(t, leechStorage, tf, data)
+
+	cancel()
+	if err := <-seeded; err != context.Canceled {
+		t.Errorf("Seed returned %v, want %v", err, context.Canceled)
+	}
+}
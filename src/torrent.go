@@ -2,25 +2,34 @@ package leecher
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
 	"os"
+	"strings"
 )
 
 // DefaultPort is the port to listen on
 const DefaultPort uint16 = 6881
 
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+	Info         bencodeInfo `bencode:"info"`
 }
 
 func generatePeerID() ([20]byte, error) {
@@ -32,42 +41,40 @@ func generatePeerID() ([20]byte, error) {
 	return peerID, nil
 }
 
-// DownloadTorrentFile downloads a torrent and writes it to a file
-func (tf *TorrentFile) DownloadTorrentFile() error {
-	peerID, err := generatePeerID()
-	if err != nil {
-		return err
-	}
+// DownloadTorrentFile downloads a torrent and writes it to disk piece by
+// piece. Cancelling ctx stops the download, see DownloadWithStorage.
+func (tf *TorrentFile) DownloadTorrentFile(ctx context.Context) error {
+	return tf.DownloadWithStorage(ctx, FileStorage{Dir: "."})
+}
 
-	peers, err := tf.requestPeers(peerID, DefaultPort)
-	if err != nil {
-		return err
-	}
+// DownloadWithStorage downloads a torrent into the given storage backend
+// and seeds it until DefaultSeedLimits is reached. When ctx is cancelled
+// the peer connections are closed, the trackers are told that we stopped,
+// storage is flushed and ctx.Err() is returned.
+func (tf *TorrentFile) DownloadWithStorage(ctx context.Context, storage Storage) error {
+	return tf.run(ctx, storage, DefaultSeedLimits, false)
+}
 
-	torrent := Torrent{
-		Peers:       peers,
-		PeerID:      peerID,
-		InfoHash:    tf.InfoHash,
-		PieceHashes: tf.PieceHashes,
-		PieceLength: tf.PieceLength,
-		Length:      tf.Length,
-		Name:        tf.Name,
-	}
-	buf, err := torrent.Download()
-	if err != nil {
-		return err
-	}
+// Seed uploads a torrent whose data is already complete in storage until
+// limits is reached or ctx is cancelled
+func (tf *TorrentFile) Seed(ctx context.Context, storage Storage, limits SeedLimits) error {
+	return tf.run(ctx, storage, limits, true)
+}
 
-	outFile, err := os.Create(tf.Name)
-	if err != nil {
-		return err
-	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
+// run downloads the torrent unless seedOnly is set, then seeds it. It
+// runs the torrent in a session of its own.
+func (tf *TorrentFile) run(ctx context.Context, storage Storage, limits SeedLimits, seedOnly bool) error {
+	session, err := NewSession(SessionConfig{Storage: storage, SeedLimits: limits})
 	if err != nil {
 		return err
 	}
-	return nil
+	defer session.Close()
+	return session.run(ctx, &sessionTorrent{
+		tf:             *tf,
+		limits:         limits,
+		seedOnly:       seedOnly,
+		stopIfComplete: !seedOnly,
+	})
 }
 
 // OpenTorrentFile parses a torrent file
@@ -112,6 +119,69 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
+// fileList returns the files described by the info dictionary with their
+// offsets into the torrent data, along with the total length
+func (i *bencodeInfo) fileList() ([]File, int, error) {
+	if err := validPathElement(i.Name); err != nil {
+		return nil, 0, err
+	}
+	if len(i.Files) == 0 {
+		return []File{{Path: []string{i.Name}, Length: i.Length}}, i.Length, nil
+	}
+
+	files := make([]File, len(i.Files))
+	offset := 0
+	for n, f := range i.Files {
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("file %d has an empty path", n)
+		}
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("file %d has negative length %d", n, f.Length)
+		}
+		for _, elem := range f.Path {
+			if err := validPathElement(elem); err != nil {
+				return nil, 0, err
+			}
+		}
+		files[n] = File{
+			Path:   append([]string{i.Name}, f.Path...),
+			Length: f.Length,
+			Offset: offset,
+		}
+		offset += f.Length
+	}
+	return files, offset, nil
+}
+
+// validPathElement rejects path components that would escape the
+// download directory
+func validPathElement(elem string) error {
+	if elem == "" || elem == "." || elem == ".." ||
+		strings.ContainsAny(elem, "/\\") {
+		return fmt.Errorf("invalid path element %q", elem)
+	}
+	return nil
+}
+
+// announceTiers returns the non-empty tiers of the announce-list with the
+// trackers shuffled inside each tier
+func (bto *bencodeTorrent) announceTiers() [][]string {
+	var tiers [][]string
+	for _, tier := range bto.AnnounceList {
+		var trackers []string
+		for _, tracker := range tier {
+			if tracker != "" {
+				trackers = append(trackers, tracker)
+			}
+		}
+		if len(trackers) > 0 {
+			tiers = append(tiers, trackers)
+		}
+	}
+	shuffleTiers(tiers)
+	return tiers
+}
+
 func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 	infoHash, err := bto.Info.hash()
 	if err != nil {
@@ -121,13 +191,19 @@ func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	files, length, err := bto.Info.fileList()
+	if err != nil {
+		return TorrentFile{}, err
+	}
 	t := TorrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		Announce:     bto.Announce,
+		AnnounceList: bto.announceTiers(),
+		InfoHash:     infoHash,
+		PieceHashes:  pieceHashes,
+		PieceLength:  bto.Info.PieceLength,
+		Length:       length,
+		Name:         bto.Info.Name,
+		Files:        files,
 	}
 	return t, nil
 }
@@ -1,8 +1,13 @@
 package leecher
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -11,70 +16,393 @@ import (
 )
 
 type bencodeTrackerResponse struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Interval       int    `bencode:"interval"`
+	MinInterval    int    `bencode:"min interval"`
+	TrackerID      string `bencode:"tracker id"`
+	Peers          string `bencode:"peers"`
+	Peers6         string `bencode:"peers6"`
 }
 
+// bencodeTrackerPeerList is the dictionary model of the peers in a tracker
+// response, used by trackers that ignore compact=1
+type bencodeTrackerPeerList struct {
+	Peers []bencodeTrackerPeer `bencode:"peers"`
+}
+
+type bencodeTrackerPeer struct {
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+// Peer is a member of the swarm. ID is zero unless the source told us the
+// peer's ID.
 type Peer struct {
 	IP   net.IP
 	Port uint16
+	ID   [20]byte
+}
+
+// TrackerError is returned when a tracker answers with a failure reason
+type TrackerError struct {
+	Tracker string
+	Reason  string
 }
 
-const peerSize = 6
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker %s refused the request: %s", e.Tracker, e.Reason)
+}
+
+// ScrapeResult holds the swarm statistics a tracker reports for a torrent
+type ScrapeResult struct {
+	InfoHash   [20]byte
+	Complete   int // seeders
+	Incomplete int // leechers
+	Downloaded int // completed downloads
+}
+
+// Sizes of the compact peer formats, IPv4 and IPv6 (BEP 7)
+const (
+	peerSize  = 6
+	peer6Size = 18
+)
+
+// announceParams are the values we report to trackers on every announce
+type announceParams struct {
+	peerID     [20]byte
+	port       uint16
+	uploaded   int64
+	downloaded int64
+	left       int64
+	event      uint32
+	key        uint32
+	// ipv6 is our global IPv6 address, if we have one
+	ipv6 net.IP
+	// trackerIDs remembers the tracker id each tracker handed out, it is
+	// updated by every announce
+	trackerIDs map[string]string
+	// udpRetries caps the resends to UDP trackers, see udpRetries
+	udpRetries int
+}
+
+// trackerResponse is the protocol independent result of an announce
+type trackerResponse struct {
+	interval    time.Duration
+	minInterval time.Duration
+	trackerID   string
+	peers       []Peer
+}
+
+// eventNames are the HTTP spellings of the announce events
+var eventNames = map[uint32]string{
+	eventCompleted: "completed",
+	eventStarted:   "started",
+	eventStopped:   "stopped",
+}
 
 func (t *TorrentFile) BuildTrackerURL(peerID [20]byte, port uint16) (string, error) {
-	base, err := url.Parse(t.Announce)
+	return t.buildTrackerURL(t.Announce, announceParams{
+		peerID: peerID,
+		port:   port,
+		left:   int64(t.Length),
+	})
+}
+
+func (t *TorrentFile) buildTrackerURL(announce string, p announceParams) (string, error) {
+	base, err := url.Parse(announce)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse tracker URL: %w", err)
 	}
-	params := url.Values{
-		"info_hash":  {string(t.InfoHash[:])},
-		"peer_id":    {string(peerID[:])},
-		"port":       {strconv.Itoa(int(port))},
-		"uploaded":   {"0"},
-		"downloaded": {"0"},
-		"compact":    {"1"},
-		"left":       {strconv.Itoa(t.Length)},
+	// Keep parameters that are part of the announce URL, like passkeys
+	params := base.Query()
+	params.Set("info_hash", string(t.InfoHash[:]))
+	params.Set("peer_id", string(p.peerID[:]))
+	params.Set("port", strconv.Itoa(int(p.port)))
+	params.Set("uploaded", strconv.FormatInt(p.uploaded, 10))
+	params.Set("downloaded", strconv.FormatInt(p.downloaded, 10))
+	params.Set("compact", "1")
+	params.Set("left", strconv.FormatInt(p.left, 10))
+	if name, ok := eventNames[p.event]; ok {
+		params.Set("event", name)
+	}
+	if p.key != 0 {
+		params.Set("key", strconv.FormatUint(uint64(p.key), 16))
+	}
+	if p.ipv6 != nil {
+		params.Set("ipv6", p.ipv6.String())
+	}
+	if id := p.trackerIDs[announce]; id != "" {
+		params.Set("trackerid", id)
 	}
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
+// trackerTiers returns a copy of the tiers of trackers to announce to,
+// which announce may reorder. Without an announce-list the announce URL
+// forms the only tier.
+func (t *TorrentFile) trackerTiers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		tiers := make([][]string, len(t.AnnounceList))
+		for i, tier := range t.AnnounceList {
+			tiers[i] = append([]string(nil), tier...)
+		}
+		return tiers
+	}
+	if t.Announce == "" {
+		return nil
+	}
+	return [][]string{{t.Announce}}
+}
+
+// requestPeers announces once, without an event, and returns the peers
 func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]Peer, error) {
-	urlStr, err := t.BuildTrackerURL(peerID, port)
+	resp, err := t.announce(context.Background(), t.trackerTiers(), announceParams{
+		peerID: peerID,
+		port:   port,
+		left:   int64(t.Length),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.peers, nil
+}
+
+// announce asks the trackers of tiers for peers, following BEP 12: the
+// tiers are tried in order and within a tier the trackers in order. The
+// first tracker that answers ends the announce and is moved to the front
+// of its tier, so tiers is reordered in place. Cancelling ctx aborts the
+// announce.
+func (t *TorrentFile) announce(ctx context.Context, tiers [][]string, p announceParams) (*trackerResponse, error) {
+	var lastErr error
+	for _, tier := range tiers {
+		for i, tracker := range tier {
+			resp, err := t.announceTo(ctx, tracker, p)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				log.Printf("Tracker %s failed: %v\n", tracker, err)
+				lastErr = err
+				continue
+			}
+			copy(tier[1:i+1], tier[0:i])
+			tier[0] = tracker
+			if resp.trackerID != "" && p.trackerIDs != nil {
+				p.trackerIDs[tracker] = resp.trackerID
+			}
+			resp.peers = dedupePeers(resp.peers)
+			return resp, nil
+		}
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("torrent has no trackers")
+	}
+	return nil, lastErr
+}
+
+// announceTo announces to a single tracker using the protocol matching the
+// scheme of its URL
+func (t *TorrentFile) announceTo(ctx context.Context, tracker string, p announceParams) (*trackerResponse, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tracker URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return t.announceHTTP(ctx, tracker, p)
+	case "udp":
+		return t.announceUDP(ctx, tracker, p)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+func (t *TorrentFile) announceHTTP(ctx context.Context, tracker string, p announceParams) (*trackerResponse, error) {
+	urlStr, err := t.buildTrackerURL(tracker, p)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build tracker URL: %w", err)
 	}
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build tracker request: %w", err)
+	}
 	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Get(urlStr)
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tracker response: %w", err)
 	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tracker response: %w", err)
+	}
+	trackerResp, err := parseTrackerResponse(tracker, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker %s answered with status %s", tracker, resp.Status)
+	}
+	return trackerResp, nil
+}
+
+// parseTrackerResponse decodes the body of an HTTP announce. Peers may come
+// in the compact format or as a list of dictionaries.
+func parseTrackerResponse(tracker string, body []byte) (*trackerResponse, error) {
 	var trackerResp bencodeTrackerResponse
-	if err := UnmarshalResponse(resp.Body, &trackerResp); err != nil {
+	if err := UnmarshalResponse(bytes.NewReader(body), &trackerResp); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal tracker response: %w", err)
 	}
+	if trackerResp.FailureReason != "" {
+		return nil, &TrackerError{Tracker: tracker, Reason: trackerResp.FailureReason}
+	}
+	if trackerResp.WarningMessage != "" {
+		log.Printf("Tracker %s warning: %s\n", tracker, trackerResp.WarningMessage)
+	}
 
-	return unmarshalPeers([]byte(trackerResp.Peers))
+	peers, err := unmarshalPeers([]byte(trackerResp.Peers))
+	if err != nil {
+		return nil, err
+	}
+	peers6, err := unmarshalPeers6([]byte(trackerResp.Peers6))
+	if err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		// Either there are no peers or they are in the dictionary model,
+		// which the first pass skipped over
+		var peerList bencodeTrackerPeerList
+		if err := UnmarshalResponse(bytes.NewReader(body), &peerList); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tracker peers: %w", err)
+		}
+		for _, p := range peerList.Peers {
+			peer, err := p.toPeer()
+			if err != nil {
+				log.Printf("Skipping peer %s from tracker: %v\n", p.IP, err)
+				continue
+			}
+			peers = append(peers, peer)
+		}
+	}
+
+	return &trackerResponse{
+		interval:    time.Duration(trackerResp.Interval) * time.Second,
+		minInterval: time.Duration(trackerResp.MinInterval) * time.Second,
+		trackerID:   trackerResp.TrackerID,
+		peers:       append(peers, peers6...),
+	}, nil
+}
+
+// toPeer converts a peer of the dictionary model. The ip may also be a DNS
+// name.
+func (p bencodeTrackerPeer) toPeer() (Peer, error) {
+	if p.Port <= 0 || p.Port > 65535 {
+		return Peer{}, fmt.Errorf("invalid port %d", p.Port)
+	}
+	peer, err := parsePeerAddr(net.JoinHostPort(p.IP, strconv.Itoa(p.Port)))
+	if err != nil {
+		return Peer{}, err
+	}
+	if len(p.PeerID) == 20 {
+		copy(peer.ID[:], p.PeerID)
+	}
+	return peer, nil
 }
 
 func unmarshalPeers(peersBin []byte) ([]Peer, error) {
-	if len(peersBin)%peerSize != 0 {
+	return unmarshalCompactPeers(peersBin, net.IPv4len)
+}
+
+// unmarshalPeers6 parses the 18 byte entries of peers6 (BEP 7)
+func unmarshalPeers6(peersBin []byte) ([]Peer, error) {
+	return unmarshalCompactPeers(peersBin, net.IPv6len)
+}
+
+func unmarshalCompactPeers(peersBin []byte, ipLen int) ([]Peer, error) {
+	entrySize := ipLen + 2
+	if len(peersBin)%entrySize != 0 {
 		return nil, fmt.Errorf("received malformed peers")
 	}
-	numPeers := len(peersBin) / peerSize
+	numPeers := len(peersBin) / entrySize
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
-		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+4 : offset+6])
+		offset := i * entrySize
+		peers[i].IP = net.IP(peersBin[offset : offset+ipLen])
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+ipLen : offset+entrySize])
 	}
 	return peers, nil
 }
 
+// compact encodes the peer as a 6 byte (IPv4) or 18 byte (IPv6) compact
+// peer entry
+func (p Peer) compact() []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], p.Port)
+	return buf
+}
+
+// localIPv6 returns a global unicast IPv6 address of this host or nil
+func localIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil {
+			continue
+		}
+		if ipNet.IP.IsGlobalUnicast() && !ipNet.IP.IsPrivate() {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+// key identifies a peer in the swarm. Peers that told us their ID are the
+// same peer whatever address (IPv4 or IPv6) they are reached on.
+func (p Peer) key() string {
+	if p.ID != [20]byte{} {
+		return "id:" + string(p.ID[:])
+	}
+	return p.String()
+}
+
+// dedupePeers drops peers that appear more than once
+func dedupePeers(peers []Peer) []Peer {
+	seen := make(map[string]bool, len(peers))
+	unique := peers[:0]
+	for _, p := range peers {
+		if seen[p.key()] || seen[p.String()] {
+			continue
+		}
+		seen[p.key()] = true
+		seen[p.String()] = true
+		unique = append(unique, p)
+	}
+	return unique
+}
+
+// shuffleTiers shuffles the trackers inside each tier as BEP 12 asks for
+func shuffleTiers(tiers [][]string) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, tier := range tiers {
+		rnd.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+	}
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.FormatUint(uint64(p.Port), 10))
 }
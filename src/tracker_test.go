@@ -0,0 +1,73 @@
+package leecher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestTracker starts an HTTP tracker answering every announce with
+// body and counts the announces
+func newTestTracker(t *testing.T, body string) (*httptest.Server, *atomic.Int32) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestAnnounceStopsAtFirstAnsweringTier(t *testing.T) {
+	failing, failingHits := newTestTracker(t, "d14:failure reason4:downe")
+	good, goodHits := newTestTracker(t, "d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e")
+	second, secondHits := newTestTracker(t, "d8:intervali60e5:peers0:e")
+
+	tf := &TorrentFile{
+		AnnounceList: [][]string{
+			{failing.URL, good.URL},
+			{second.URL},
+		},
+	}
+	original := tf.trackerTiers()
+	tiers := tf.trackerTiers()
+	resp, err := tf.announce(context.Background(), tiers, announceParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.peers) != 1 || resp.peers[0].Port != 6881 {
+		t.Errorf("got peers %v, want the peer of the answering tracker", resp.peers)
+	}
+	if failingHits.Load() != 1 || goodHits.Load() != 1 || secondHits.Load() != 0 {
+		t.Errorf("announces per tracker: %d, %d, %d, want 1, 1, 0",
+			failingHits.Load(), goodHits.Load(), secondHits.Load())
+	}
+	if tiers[0][0] != good.URL {
+		t.Errorf("the answering tracker was not moved to the front: %v", tiers[0])
+	}
+	if !reflect.DeepEqual(tf.AnnounceList, original) {
+		t.Errorf("the TorrentFile's announce-list was reordered: %v", tf.AnnounceList)
+	}
+}
+
+func TestAnnounceCancelled(t *testing.T) {
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	tf := &TorrentFile{Announce: hanging.URL}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := tf.announce(ctx, tf.trackerTiers(), announceParams{}); err != context.DeadlineExceeded {
+		t.Errorf("announce returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("announce took %v after ctx was done", elapsed)
+	}
+}
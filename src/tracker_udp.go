@@ -0,0 +1,335 @@
+package leecher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpConnectionIDLifetime is how long a tracker honours a connection ID
+	udpConnectionIDLifetime = time.Minute
+	// udpMaxRetries is the largest n in the 15*2^n retransmission timeout
+	// BEP 15 allows
+	udpMaxRetries = 8
+	// DefaultUDPTrackerRetries is how often a request to a UDP tracker is
+	// resent before the tracker counts as down. Waiting through all 8
+	// retries of BEP 15 takes over two hours, so by default we give up
+	// after 105 seconds and move on to the next tracker.
+	DefaultUDPTrackerRetries = 2
+)
+
+// Announce events, numbered as in BEP 15
+const (
+	eventNone      = 0
+	eventCompleted = 1
+	eventStarted   = 2
+	eventStopped   = 3
+)
+
+type udpConnectionID struct {
+	id       uint64
+	obtained time.Time
+}
+
+// udpConnectionIDs caches connection IDs per tracker address so repeated
+// announces can skip the connect round trip
+var udpConnectionIDs = struct {
+	sync.Mutex
+	ids map[string]udpConnectionID
+}{ids: make(map[string]udpConnectionID)}
+
+type udpTracker struct {
+	host string
+	conn net.Conn
+	// n is the retransmission count of BEP 15. It only grows, so the
+	// connect requests a transaction needs wait on the same budget.
+	n       int
+	retries int
+}
+
+type udpAnnounceRequest struct {
+	infoHash   [20]byte
+	peerID     [20]byte
+	downloaded int64
+	left       int64
+	uploaded   int64
+	event      uint32
+	key        uint32
+	port       uint16
+}
+
+type udpAnnounceResponse struct {
+	interval int
+	leechers int
+	seeders  int
+	peers    []Peer
+}
+
+// dialUDPTracker opens a UDP socket to the tracker of an udp:// URL.
+// Requests are resent up to retries times, see udpRetries.
+func dialUDPTracker(announce string, retries int) (*udpTracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tracker URL: %w", err)
+	}
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("expected udp tracker but got scheme %q", u.Scheme)
+	}
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTracker{host: u.Host, conn: conn, retries: udpRetries(retries)}, nil
+}
+
+func (tr *udpTracker) Close() error {
+	return tr.conn.Close()
+}
+
+func udpTimeout(n int) time.Duration {
+	return 15 * time.Second << n
+}
+
+// udpRetries is the number of retries to use for a configured value:
+// DefaultUDPTrackerRetries if it is not positive and at most the limit of
+// BEP 15
+func udpRetries(retries int) int {
+	switch {
+	case retries <= 0:
+		return DefaultUDPTrackerRetries
+	case retries > udpMaxRetries:
+		return udpMaxRetries
+	}
+	return retries
+}
+
+func randomUint32() (uint32, error) {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+// connectionID returns a cached connection ID for the tracker or obtains a
+// new one with a connect request
+func (tr *udpTracker) connectionID() (uint64, error) {
+	udpConnectionIDs.Lock()
+	cached, ok := udpConnectionIDs.ids[tr.host]
+	udpConnectionIDs.Unlock()
+	if ok && time.Since(cached.obtained) < udpConnectionIDLifetime {
+		return cached.id, nil
+	}
+
+	resp, err := tr.transact(udpActionConnect, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 8 {
+		return 0, fmt.Errorf("connect response too short. %d < 8", len(resp))
+	}
+	id := binary.BigEndian.Uint64(resp[0:8])
+
+	udpConnectionIDs.Lock()
+	udpConnectionIDs.ids[tr.host] = udpConnectionID{id: id, obtained: time.Now()}
+	udpConnectionIDs.Unlock()
+	return id, nil
+}
+
+// forgetConnectionID drops a connection ID the tracker no longer accepts
+func (tr *udpTracker) forgetConnectionID() {
+	udpConnectionIDs.Lock()
+	delete(udpConnectionIDs.ids, tr.host)
+	udpConnectionIDs.Unlock()
+}
+
+// transact sends a request and waits for the matching response, resending
+// it with the 15*2^n timeout of BEP 15. It returns the response without the
+// action and transaction ID.
+func (tr *udpTracker) transact(action uint32, body []byte) ([]byte, error) {
+	for ; tr.n <= tr.retries; tr.n++ {
+		connID := uint64(udpProtocolID)
+		if action != udpActionConnect {
+			id, err := tr.connectionID()
+			if err != nil {
+				return nil, err
+			}
+			connID = id
+		}
+		txID, err := randomUint32()
+		if err != nil {
+			return nil, err
+		}
+
+		req := make([]byte, 16+len(body))
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], action)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		copy(req[16:], body)
+		if _, err := tr.conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		resp, err := tr.receive(txID, time.Now().Add(udpTimeout(tr.n)))
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// The connection ID may have expired while we were waiting
+			if action != udpActionConnect {
+				tr.forgetConnectionID()
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		respAction := binary.BigEndian.Uint32(resp[0:4])
+		if respAction == udpActionError {
+			return nil, &TrackerError{Tracker: tr.host, Reason: string(resp[8:])}
+		}
+		if respAction != action {
+			return nil, fmt.Errorf("expected action %d but got %d", action, respAction)
+		}
+		return resp[8:], nil
+	}
+	return nil, fmt.Errorf("tracker %s did not respond", tr.host)
+}
+
+// receive reads packets until one carries txID or the deadline passes
+func (tr *udpTracker) receive(txID uint32, deadline time.Time) ([]byte, error) {
+	tr.conn.SetReadDeadline(deadline)
+	defer tr.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := tr.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+			continue // stray or truncated packet
+		}
+		return buf[:n], nil
+	}
+}
+
+// announce sends an announce request and parses the peers from the reply
+func (tr *udpTracker) announce(req udpAnnounceRequest) (*udpAnnounceResponse, error) {
+	body := make([]byte, 82)
+	copy(body[0:20], req.infoHash[:])
+	copy(body[20:40], req.peerID[:])
+	binary.BigEndian.PutUint64(body[40:48], uint64(req.downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(req.left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(req.uploaded))
+	binary.BigEndian.PutUint32(body[64:68], req.event)
+	binary.BigEndian.PutUint32(body[68:72], 0) // let the tracker use our source address
+	binary.BigEndian.PutUint32(body[72:76], req.key)
+	binary.BigEndian.PutUint32(body[76:80], 0xffffffff) // num_want -1, the tracker's default
+	binary.BigEndian.PutUint16(body[80:82], req.port)
+
+	resp, err := tr.transact(udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("announce response too short. %d < 12", len(resp))
+	}
+	// Trackers reached over IPv6 answer with IPv6 peers (BEP 15)
+	unmarshal := unmarshalPeers
+	if addr, ok := tr.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		unmarshal = unmarshalPeers6
+	}
+	peers, err := unmarshal(resp[12:])
+	if err != nil {
+		return nil, err
+	}
+	return &udpAnnounceResponse{
+		interval: int(binary.BigEndian.Uint32(resp[0:4])),
+		leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+		peers:    peers,
+	}, nil
+}
+
+// scrape asks the tracker for the swarm statistics of up to about 70
+// infohashes
+func (tr *udpTracker) scrape(infoHashes [][20]byte) ([]ScrapeResult, error) {
+	body := make([]byte, 0, 20*len(infoHashes))
+	for _, h := range infoHashes {
+		body = append(body, h[:]...)
+	}
+	resp, err := tr.transact(udpActionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response too short for %d infohashes", len(infoHashes))
+	}
+	results := make([]ScrapeResult, len(infoHashes))
+	for i, h := range infoHashes {
+		entry := resp[i*12 : (i+1)*12]
+		results[i] = ScrapeResult{
+			InfoHash:   h,
+			Complete:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+			Incomplete: int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+	return results, nil
+}
+
+// announceUDP announces to an udp:// tracker
+func (t *TorrentFile) announceUDP(ctx context.Context, tracker string, p announceParams) (*trackerResponse, error) {
+	tr, err := dialUDPTracker(tracker, p.udpRetries)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+
+	// Closing the socket wakes up a read waiting for the tracker
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			tr.Close()
+		case <-finished:
+		}
+	}()
+
+	resp, err := tr.announce(udpAnnounceRequest{
+		infoHash:   t.InfoHash,
+		peerID:     p.peerID,
+		downloaded: p.downloaded,
+		left:       p.left,
+		uploaded:   p.uploaded,
+		event:      p.event,
+		key:        p.key,
+		port:       p.port,
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to announce to %s: %w", tr.host, err)
+	}
+	return &trackerResponse{
+		interval: time.Duration(resp.interval) * time.Second,
+		peers:    resp.peers,
+	}, nil
+}